@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"os/signal"
 	"runtime"
+	"syscall"
 
+	"github.com/zihaolam/golang-media-upload-server/internal"
 	"github.com/zihaolam/golang-media-upload-server/internal/api"
 )
 
 func main() {
 	runtime.GOMAXPROCS(10)
+	internal.LoadEnv()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	api := api.NewApi()
-	api.Setup()
+	api.Setup(ctx)
 }
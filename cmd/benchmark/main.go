@@ -0,0 +1,103 @@
+// benchmark compares encoding a video with one ffmpeg process per rendition against a single
+// ffmpeg process that decodes the source once. It only encodes locally and uploads nothing,
+// but reads the same .env as the server
+//
+//	go run cmd/benchmark/main.go -input video.mp4 -profile premium-1080p -runs 3
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	ffprobe "github.com/vansante/go-ffprobe"
+	"github.com/zihaolam/golang-media-upload-server/internal"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/mediautils"
+)
+
+type result struct {
+	wall time.Duration
+	cpu  time.Duration
+}
+
+// childCPUTime returns the user and system time used by terminated child processes, i.e. ffmpeg
+func childCPUTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &usage); err != nil {
+		log.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func run(ctx context.Context, input string, ladder []mediautils.Rendition, probe *ffprobe.ProbeData, singlePass bool) result {
+	outputDir, err := os.MkdirTemp("", "benchmark")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	cpuBefore := childCPUTime()
+	start := time.Now()
+
+	if _, err := mediautils.EncodeHLS(ctx, input, outputDir, "benchmark", &mediautils.TranscodeOptions{
+		Duration:   probe.Format.DurationSeconds,
+		Ladder:     ladder,
+		Probe:      probe,
+		SinglePass: singlePass,
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	return result{
+		wall: time.Since(start),
+		cpu:  childCPUTime() - cpuBefore,
+	}
+}
+
+func main() {
+	input := flag.String("input", "", "video file to encode")
+	profile := flag.String("profile", "", "ladder preset, the default ladder when empty")
+	runs := flag.Int("runs", 1, "number of runs of each mode")
+	flag.Parse()
+
+	if *input == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	internal.LoadEnv()
+	ctx := context.Background()
+
+	ladder, err := mediautils.GetLadder(*profile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	probe, err := ffprobe.GetProbeDataContext(ctx, *input)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%s, %.1fs, %d renditions, %d run(s) per mode\n", *input, probe.Format.DurationSeconds, len(ladder), *runs)
+	fmt.Printf("%-12s %12s %12s\n", "mode", "wall", "cpu")
+
+	for _, singlePass := range []bool{false, true} {
+		mode := "parallel"
+		if singlePass {
+			mode = "single-pass"
+		}
+
+		var total result
+		for i := 0; i < *runs; i++ {
+			r := run(ctx, *input, ladder, probe, singlePass)
+			total.wall += r.wall
+			total.cpu += r.cpu
+		}
+
+		fmt.Printf("%-12s %12s %12s\n", mode, (total.wall / time.Duration(*runs)).Round(time.Millisecond), (total.cpu / time.Duration(*runs)).Round(time.Millisecond))
+	}
+}
@@ -2,14 +2,16 @@ module github.com/zihaolam/golang-media-upload-server
 
 go 1.21.1
 
-require github.com/u2takey/ffmpeg-go v0.5.0
+require (
+	github.com/google/uuid v1.5.0
+	github.com/u2takey/ffmpeg-go v0.5.0
+)
 
 require (
 	github.com/andybalholm/brotli v1.0.5 // indirect
 	github.com/gabriel-vasile/mimetype v1.4.3 // indirect
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
-	github.com/google/uuid v1.5.0 // indirect
 	github.com/klauspost/compress v1.17.2 // indirect
 	github.com/leodido/go-urn v1.4.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
@@ -28,7 +30,7 @@ require (
 )
 
 require (
-	github.com/aws/aws-sdk-go v1.38.20 // indirect
+	github.com/aws/aws-sdk-go v1.38.20
 	github.com/go-playground/validator/v10 v10.19.0
 	github.com/gofiber/fiber/v2 v2.52.2
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
@@ -38,4 +40,5 @@ require (
 	github.com/spf13/cast v1.6.0
 	github.com/u2takey/go-utils v0.3.1 // indirect
 	github.com/vansante/go-ffprobe v1.1.0
+	go.etcd.io/bbolt v1.3.9
 )
@@ -1,8 +1,10 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -13,15 +15,23 @@ import (
 
 type api struct {
 	app *fiber.App
+	// run when a shutdown signal is received, before the http server stops
+	drainHooks []func(ctx context.Context)
+	// cancelled once the drain deadline passes, for work that runs inside a request
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type Handler = func(c *fiber.Ctx) error
 
 func NewApi() *api {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &api{
 		app: fiber.New(fiber.Config{
 			BodyLimit: 1024 * 1024 * 1024, // this is the default limit of 4MB
 		}),
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
@@ -41,17 +51,57 @@ func setupLogger(app *fiber.App) {
 	}))
 }
 
-func (a *api) Setup() {
+// Context is done once the server has stopped waiting for in-flight work to finish
+func (a *api) Context() context.Context {
+	return a.ctx
+}
+
+func (a *api) Setup(ctx context.Context) {
 	setupCORS(a.app)
 	setupLogger(a.app)
 	a.RegisterRoutes()
-	a.Serve()
+	a.Serve(ctx)
+}
+
+// OnDrain registers a hook that gets to finish in-flight work once the server is asked to stop
+func (a *api) OnDrain(hook func(ctx context.Context)) {
+	a.drainHooks = append(a.drainHooks, hook)
 }
 
-func (a *api) Serve() {
-	err := a.app.Listen(fmt.Sprintf("%s:%s", internal.Env.Host, internal.Env.Port))
-	if err != nil {
-		log.Fatal(err)
+// Serve listens until ctx is done, then drains in-flight work and shuts the server down
+// within the configured shutdown timeout
+func (a *api) Serve(ctx context.Context) {
+	go func() {
+		err := a.app.Listen(fmt.Sprintf("%s:%s", internal.Env.Host, internal.Env.Port))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("shutting down")
+
+	timeout := time.Duration(internal.Env.ShutdownTimeout) * time.Second
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// requests still transcoding at the deadline are interrupted so their ffmpeg processes
+	// and temp dirs are cleaned up before the process exits
+	stop := context.AfterFunc(drainCtx, a.cancel)
+	defer stop()
+
+	for _, hook := range a.drainHooks {
+		hook(drainCtx)
+	}
+
+	// open requests get until the deadline, plus a few seconds for interrupted ones to clean up
+	httpTimeout := 5 * time.Second
+	if deadline, ok := drainCtx.Deadline(); ok {
+		httpTimeout += max(time.Until(deadline), 0)
+	}
+
+	if err := a.app.ShutdownWithTimeout(httpTimeout); err != nil {
+		log.Println(err)
 	}
 }
 
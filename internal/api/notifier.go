@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/job"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/queue"
+)
+
+// jobNotifier reports the lifecycle of a job to whoever submitted it
+type jobNotifier interface {
+	Started(ctx context.Context, jobId string) error
+	Progress(ctx context.Context, progress *job.JobProgressRequest) error
+	Completed(ctx context.Context, result *job.JobCompletionRequest) error
+	Failed(ctx context.Context, jobId string, err error, attempts int) error
+	Cancelled(ctx context.Context, jobId string) error
+}
+
+// platformNotifier sends webhooks for jobs created by the video platform
+type platformNotifier struct {
+	js *job.JobService
+}
+
+func (n *platformNotifier) Started(ctx context.Context, jobId string) error {
+	return n.js.SendJobProcessingStartedWebhook(ctx, jobId)
+}
+
+func (n *platformNotifier) Progress(ctx context.Context, progress *job.JobProgressRequest) error {
+	return n.js.SendJobProgressWebhook(ctx, progress)
+}
+
+func (n *platformNotifier) Completed(ctx context.Context, result *job.JobCompletionRequest) error {
+	return n.js.SendJobCompletionWebhook(ctx, result)
+}
+
+func (n *platformNotifier) Failed(ctx context.Context, jobId string, err error, attempts int) error {
+	return n.js.SendJobProcessingFailedWebhook(ctx, jobId, err, attempts)
+}
+
+func (n *platformNotifier) Cancelled(ctx context.Context, jobId string) error {
+	return n.js.SendJobCancelledWebhook(ctx, jobId)
+}
+
+// callbackNotifier posts the outcome of an uploaded job to the callback url given by the caller,
+// intermediate events are only visible through the job status api
+type callbackNotifier struct {
+	js          *job.JobService
+	callbackUrl string
+}
+
+func (n *callbackNotifier) Started(ctx context.Context, jobId string) error {
+	return nil
+}
+
+func (n *callbackNotifier) Progress(ctx context.Context, progress *job.JobProgressRequest) error {
+	return nil
+}
+
+func (n *callbackNotifier) Completed(ctx context.Context, result *job.JobCompletionRequest) error {
+	if n.callbackUrl == "" {
+		return nil
+	}
+	return n.js.SendCallback(ctx, n.callbackUrl, result)
+}
+
+func (n *callbackNotifier) Failed(ctx context.Context, jobId string, err error, attempts int) error {
+	if n.callbackUrl == "" {
+		return nil
+	}
+	return n.js.SendCallback(ctx, n.callbackUrl, map[string]any{
+		"id":       jobId,
+		"status":   job.StatusFailed,
+		"error":    err.Error(),
+		"attempts": attempts,
+	})
+}
+
+func (n *callbackNotifier) Cancelled(ctx context.Context, jobId string) error {
+	if n.callbackUrl == "" {
+		return nil
+	}
+	return n.js.SendCallback(ctx, n.callbackUrl, map[string]any{
+		"id":     jobId,
+		"status": job.StatusCancelled,
+	})
+}
+
+func newJobNotifier(js *job.JobService, r *queue.Record) jobNotifier {
+	if r.Options.Upload != nil {
+		return &callbackNotifier{
+			js:          js,
+			callbackUrl: r.Options.Upload.CallbackUrl,
+		}
+	}
+	return &platformNotifier{
+		js: js,
+	}
+}
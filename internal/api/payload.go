@@ -0,0 +1,77 @@
+package api
+
+import (
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/job"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/mediautils"
+)
+
+// the webhook payloads of the job package are kept free of mediautils, so results are mapped here
+
+func toJobLadder(ladder []mediautils.Rendition) []job.Rendition {
+	if len(ladder) == 0 {
+		return nil
+	}
+
+	renditions := make([]job.Rendition, 0, len(ladder))
+	for _, rendition := range ladder {
+		renditions = append(renditions, job.Rendition{
+			Name:         rendition.Name,
+			Width:        rendition.Width,
+			Height:       rendition.Height,
+			VideoBitRate: rendition.VideoBitRate,
+			AudioBitRate: rendition.AudioBitRate,
+			MaxRate:      rendition.MaxRate,
+			BufSize:      rendition.BufSize,
+			Profile:      rendition.Profile,
+			Codec:        rendition.Codec,
+			RateControl:  rendition.RateControl,
+			CRF:          rendition.CRF,
+		})
+	}
+	return renditions
+}
+
+func toJobComplexity(analysis *mediautils.ComplexityAnalysis) *job.Complexity {
+	if analysis == nil {
+		return nil
+	}
+
+	return &job.Complexity{
+		BitsPerPixel: analysis.BitsPerPixel,
+		Factor:       analysis.Factor,
+	}
+}
+
+func toJobQuality(quality []mediautils.RenditionQuality) []job.RenditionQuality {
+	if len(quality) == 0 {
+		return nil
+	}
+
+	scores := make([]job.RenditionQuality, 0, len(quality))
+	for _, rendition := range quality {
+		scores = append(scores, job.RenditionQuality{
+			Rendition: rendition.Rendition,
+			PSNR:      rendition.PSNR,
+			SSIM:      rendition.SSIM,
+			VMAF:      rendition.VMAF,
+		})
+	}
+	return scores
+}
+
+func toJobImages(images []mediautils.PosterImage) []job.Image {
+	if len(images) == 0 {
+		return nil
+	}
+
+	jobImages := make([]job.Image, 0, len(images))
+	for _, image := range images {
+		jobImages = append(jobImages, job.Image{
+			Url:    image.Url,
+			Width:  image.Width,
+			Height: image.Height,
+			Format: image.Format,
+		})
+	}
+	return jobImages
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/job"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/queue"
+)
+
+type jobProgress struct {
+	Renditions    map[string]float64 `json:"renditions"`
+	Percent       float64            `json:"percent"`
+	UpdatedAt     time.Time          `json:"updatedAt"`
+	lastWebhookAt time.Time
+	notifier      jobNotifier
+	// context of the running job, so that pending webhooks are abandoned with it
+	ctx context.Context
+}
+
+// progressTracker keeps the encode progress of running jobs in memory and
+// forwards it to the job's notifier at most once per interval
+type progressTracker struct {
+	mu       sync.RWMutex
+	jobs     map[string]*jobProgress
+	interval time.Duration
+}
+
+func newProgressTracker(interval time.Duration) *progressTracker {
+	return &progressTracker{
+		jobs:     map[string]*jobProgress{},
+		interval: interval,
+	}
+}
+
+func (pt *progressTracker) track(ctx context.Context, jobId string, notifier jobNotifier) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.jobs[jobId] = &jobProgress{
+		Renditions: map[string]float64{},
+		notifier:   notifier,
+		ctx:        ctx,
+	}
+}
+
+func (pt *progressTracker) update(jobId, rendition string, percent float64) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	p, ok := pt.jobs[jobId]
+	if !ok {
+		return
+	}
+
+	p.Renditions[rendition] = percent
+	p.UpdatedAt = time.Now()
+
+	total := 0.0
+	for _, renditionPercent := range p.Renditions {
+		total += renditionPercent
+	}
+	p.Percent = total / float64(len(p.Renditions))
+
+	if p.UpdatedAt.Sub(p.lastWebhookAt) < pt.interval {
+		return
+	}
+	p.lastWebhookAt = p.UpdatedAt
+
+	req := &job.JobProgressRequest{
+		Id:         jobId,
+		Stage:      queue.StageTranscoding,
+		Percent:    p.Percent,
+		Renditions: copyRenditionProgress(p.Renditions),
+	}
+
+	go func() {
+		if err := p.notifier.Progress(p.ctx, req); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+func (pt *progressTracker) get(jobId string) (*jobProgress, bool) {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	p, ok := pt.jobs[jobId]
+	if !ok {
+		return nil, false
+	}
+
+	return &jobProgress{
+		Renditions: copyRenditionProgress(p.Renditions),
+		Percent:    p.Percent,
+		UpdatedAt:  p.UpdatedAt,
+	}, true
+}
+
+func (pt *progressTracker) remove(jobId string) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	delete(pt.jobs, jobId)
+}
+
+func copyRenditionProgress(renditions map[string]float64) map[string]float64 {
+	copied := make(map[string]float64, len(renditions))
+	for rendition, percent := range renditions {
+		copied[rendition] = percent
+	}
+	return copied
+}
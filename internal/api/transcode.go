@@ -2,34 +2,63 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	ffprobe "github.com/vansante/go-ffprobe"
+	"github.com/zihaolam/golang-media-upload-server/internal"
 	fileutils "github.com/zihaolam/golang-media-upload-server/internal/pkg/file"
 	"github.com/zihaolam/golang-media-upload-server/internal/pkg/job"
 	"github.com/zihaolam/golang-media-upload-server/internal/pkg/mediautils"
 	"github.com/zihaolam/golang-media-upload-server/internal/pkg/openai"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/queue"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/retry"
 	"github.com/zihaolam/golang-media-upload-server/internal/pkg/s3"
 	"github.com/zihaolam/golang-media-upload-server/internal/pkg/utils"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/worker"
 )
 
 type transcodeApi struct {
-	api   *api
-	jobCh chan job.Job
+	api      *api
+	queue    *queue.Queue
+	pool     *worker.Pool
+	progress *progressTracker
+	// set once the server is shutting down, new jobs are refused from then on
+	draining atomic.Bool
 }
 
 func NewTranscodeApi(a *api) *transcodeApi {
+	q, err := queue.NewQueue(internal.Env.JobQueuePath, internal.Env.JobQueueMaxDepth, time.Duration(internal.Env.JobRetention)*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.MkdirAll(internal.Env.UploadDir, os.ModePerm); err != nil {
+		log.Fatal(err)
+	}
+
+	if internal.Env.LadderConfigFile != "" {
+		if err := mediautils.LoadLadderConfig(internal.Env.LadderConfigFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	return &transcodeApi{
-		api:   a,
-		jobCh: make(chan job.Job),
+		api:      a,
+		queue:    q,
+		progress: newProgressTracker(time.Duration(internal.Env.JobProgressInterval) * time.Second),
 	}
 }
 
@@ -39,12 +68,353 @@ func (ta *transcodeApi) Setup() {
 	transcodeApiGroup := ta.api.NewRouteGroup("/transcode")
 	transcodeApiGroup.Post("/video", ta.handleVideoTranscode())
 	transcodeApiGroup.Post(fmt.Sprintf("/job/:%s", JOB_ID_PARAM), ta.handleVideoTranscodeJob())
+	transcodeApiGroup.Get(fmt.Sprintf("/job/:%s", JOB_ID_PARAM), ta.handleGetJob())
+	transcodeApiGroup.Get(fmt.Sprintf("/job/:%s/progress", JOB_ID_PARAM), ta.handleGetJobProgress())
+	transcodeApiGroup.Post(fmt.Sprintf("/job/:%s/cancel", JOB_ID_PARAM), ta.handleCancelJob())
+	transcodeApiGroup.Get("/jobs", ta.handleListJobs())
 	transcodeApiGroup.Post("/image", ta.handleImageTranscode())
+	transcodeApiGroup.Get("/workers", ta.handleGetWorkers())
 	ta.handleJobs()
+	ta.api.OnDrain(ta.drain)
+	ta.api.app.Hooks().OnShutdown(ta.queue.Close)
+}
+
+func (ta *transcodeApi) drain(ctx context.Context) {
+	ta.draining.Store(true)
+	ta.pool.Shutdown(ctx, internal.Env.ShutdownRequeueJobs)
+}
+
+// async requests are opted into with ?async=true or the "Prefer: respond-async" header
+func isAsyncRequest(c *fiber.Ctx) bool {
+	return c.QueryBool("async") || strings.Contains(c.Get("Prefer"), "respond-async")
+}
+
+func isValidCallbackUrl(callbackUrl string) bool {
+	u, err := url.ParseRequestURI(callbackUrl)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// transcodeRequest selects the rendition ladder of a transcode, either by preset name or with custom renditions,
+// and the audio track to transcribe
+type transcodeRequest struct {
+	Profile string                 `json:"profile"`
+	Ladder  []mediautils.Rendition `json:"ladder"`
+	// encodes audio once into a shared audio group, defaults to SEPARATE_AUDIO
+	SeparateAudio *bool                       `json:"separateAudio"`
+	AudioLadder   []mediautils.AudioRendition `json:"audioLadder"`
+	// index or language of the audio track to transcribe, defaults to the default track of the source
+	TranscribeTrack    *int   `json:"transcribeTrack"`
+	TranscribeLanguage string `json:"transcribeLanguage"`
+	// ts or fmp4, defaults to HLS_SEGMENT_FORMAT
+	SegmentFormat string `json:"segmentFormat"`
+	// also writes a dash manifest, defaults to DASH_OUTPUT
+	Dash *bool `json:"dash"`
+	// encodes all renditions from one ffmpeg process, defaults to SINGLE_PASS_ENCODE
+	SinglePass *bool `json:"singlePass"`
+	// adapts the ladder bitrates to the complexity of the source, defaults to PER_TITLE_ENCODE
+	PerTitle *bool `json:"perTitle"`
+	// measures psnr, ssim and vmaf of every rendition, defaults to QUALITY_REPORT
+	QualityReport *bool `json:"qualityReport"`
+	// seconds between thumbnails of the scrubbing preview sprites where 0 disables them, defaults to THUMBNAIL_INTERVAL_SECONDS
+	ThumbnailInterval *int `json:"thumbnailInterval"`
+	// jpeg, png or webp, defaults to THUMBNAIL_FORMAT
+	ThumbnailFormat string `json:"thumbnailFormat"`
+	// generates a poster from the best of a set of sampled frames, defaults to POSTER
+	Poster *bool `json:"poster"`
+}
+
+func (lr *transcodeRequest) singlePass() bool {
+	if lr.SinglePass != nil {
+		return *lr.SinglePass
+	}
+	return internal.Env.SinglePassEncode
+}
+
+func (lr *transcodeRequest) perTitle() bool {
+	if lr.PerTitle != nil {
+		return *lr.PerTitle
+	}
+	return internal.Env.PerTitleEncode
+}
+
+func (lr *transcodeRequest) qualityReport() bool {
+	if lr.QualityReport != nil {
+		return *lr.QualityReport
+	}
+	return internal.Env.QualityReport
+}
+
+func (lr *transcodeRequest) poster() bool {
+	if lr.Poster != nil {
+		return *lr.Poster
+	}
+	return internal.Env.Poster
+}
+
+// thumbnails returns the thumbnail sprites to generate, nil when they are disabled
+func (lr *transcodeRequest) thumbnails() (*mediautils.ThumbnailOptions, error) {
+	interval := internal.Env.ThumbnailInterval
+	if lr.ThumbnailInterval != nil {
+		interval = *lr.ThumbnailInterval
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("invalid thumbnail interval %d", interval)
+	}
+	if interval == 0 {
+		return nil, nil
+	}
+
+	format := internal.Env.ThumbnailFormat
+	if lr.ThumbnailFormat != "" {
+		format = lr.ThumbnailFormat
+	}
+	if !mediautils.CheckValidImageFormat(format) {
+		return nil, fmt.Errorf("invalid thumbnail format %s", format)
+	}
+
+	return &mediautils.ThumbnailOptions{
+		Interval: interval,
+		Format:   format,
+	}, nil
+}
+
+// output returns the segment format and whether a dash manifest is written,
+// where dash implies fmp4 segments
+func (lr *transcodeRequest) output() (string, bool, error) {
+	dash := internal.Env.DashOutput
+	if lr.Dash != nil {
+		dash = *lr.Dash
+	}
+
+	if lr.SegmentFormat == "" {
+		if dash {
+			return mediautils.SEGMENT_FORMAT_FMP4, true, nil
+		}
+		return internal.Env.HLSSegmentFormat, false, nil
+	}
+
+	if !mediautils.CheckValidSegmentFormat(lr.SegmentFormat) {
+		return "", false, fmt.Errorf("invalid segment format %s", lr.SegmentFormat)
+	}
+
+	if dash && lr.SegmentFormat != mediautils.SEGMENT_FORMAT_FMP4 {
+		return "", false, fmt.Errorf("dash output requires %s segments", mediautils.SEGMENT_FORMAT_FMP4)
+	}
+
+	return lr.SegmentFormat, dash, nil
+}
+
+func (lr *transcodeRequest) resolve() ([]mediautils.Rendition, []mediautils.AudioRendition, error) {
+	ladder, err := mediautils.ResolveLadder(lr.Profile, lr.Ladder)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	separateAudio := internal.Env.SeparateAudio
+	if lr.SeparateAudio != nil {
+		separateAudio = *lr.SeparateAudio
+	}
+
+	audioLadder, err := mediautils.ResolveAudioLadder(separateAudio, lr.AudioLadder, ladder)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ladder, audioLadder, nil
+}
+
+// parses the "profile", "separateAudio", "segmentFormat", "dash", "singlePass", "perTitle", "qualityReport", "transcribeTrack",
+// "transcribeLanguage", "thumbnailInterval", "thumbnailFormat", "poster" and json encoded "ladder" and "audioLadder" fields of a multipart form
+func parseTranscodeForm(c *fiber.Ctx) (*transcodeRequest, error) {
+	lr := transcodeRequest{
+		Profile:            c.FormValue("profile"),
+		TranscribeLanguage: c.FormValue("transcribeLanguage"),
+		SegmentFormat:      c.FormValue("segmentFormat"),
+		ThumbnailFormat:    c.FormValue("thumbnailFormat"),
+	}
+
+	if dash := c.FormValue("dash"); dash != "" {
+		value := dash == "true"
+		lr.Dash = &value
+	}
+
+	if singlePass := c.FormValue("singlePass"); singlePass != "" {
+		value := singlePass == "true"
+		lr.SinglePass = &value
+	}
+
+	if perTitle := c.FormValue("perTitle"); perTitle != "" {
+		value := perTitle == "true"
+		lr.PerTitle = &value
+	}
+
+	if qualityReport := c.FormValue("qualityReport"); qualityReport != "" {
+		value := qualityReport == "true"
+		lr.QualityReport = &value
+	}
+
+	if poster := c.FormValue("poster"); poster != "" {
+		value := poster == "true"
+		lr.Poster = &value
+	}
+
+	if transcribeTrack := c.FormValue("transcribeTrack"); transcribeTrack != "" {
+		track, err := strconv.Atoi(transcribeTrack)
+		if err != nil {
+			return nil, err
+		}
+		lr.TranscribeTrack = &track
+	}
+
+	if thumbnailInterval := c.FormValue("thumbnailInterval"); thumbnailInterval != "" {
+		interval, err := strconv.Atoi(thumbnailInterval)
+		if err != nil {
+			return nil, err
+		}
+		lr.ThumbnailInterval = &interval
+	}
+
+	if ladder := c.FormValue("ladder"); ladder != "" {
+		if err := json.Unmarshal([]byte(ladder), &lr.Ladder); err != nil {
+			return nil, err
+		}
+	}
+
+	if separateAudio := c.FormValue("separateAudio"); separateAudio != "" {
+		value := separateAudio == "true"
+		lr.SeparateAudio = &value
+	}
+
+	if audioLadder := c.FormValue("audioLadder"); audioLadder != "" {
+		if err := json.Unmarshal([]byte(audioLadder), &lr.AudioLadder); err != nil {
+			return nil, err
+		}
+	}
+
+	return &lr, nil
+}
+
+func (ta *transcodeApi) handleAsyncVideoTranscode(c *fiber.Ctx) error {
+	if ta.draining.Load() {
+		return fiber.ErrServiceUnavailable
+	}
+
+	callbackUrl := c.FormValue("callbackUrl")
+	if callbackUrl != "" && !isValidCallbackUrl(callbackUrl) {
+		return fiber.ErrBadRequest
+	}
+
+	lr, err := parseTranscodeForm(c)
+	if err != nil {
+		return fiber.ErrBadRequest
+	}
+
+	ladder, audioLadder, err := lr.resolve()
+	if err != nil {
+		log.Println(err)
+		return fiber.ErrBadRequest
+	}
+
+	segmentFormat, dash, err := lr.output()
+	if err != nil {
+		log.Println(err)
+		return fiber.ErrBadRequest
+	}
+
+	thumbnails, err := lr.thumbnails()
+	if err != nil {
+		log.Println(err)
+		return fiber.ErrBadRequest
+	}
+
+	videoFilename, err := fileutils.SaveFileFromCtxToDir(c, "file", internal.Env.UploadDir)
+
+	if err != nil {
+		log.Println(err)
+		return fiber.ErrInternalServerError
+	}
+
+	if !strings.HasSuffix(videoFilename, ".mp4") {
+		os.Remove(videoFilename)
+		return fiber.ErrBadRequest
+	}
+
+	r, err := ta.queue.Enqueue(job.Job{
+		Id:       uuid.NewString(),
+		Status:   job.StatusPending,
+		VideoUrl: videoFilename,
+	}, queue.Options{
+		Upload: &queue.Upload{
+			FilePath:    videoFilename,
+			CallbackUrl: callbackUrl,
+			Transcribe:  c.FormValue("transcribe") == "true",
+		},
+		Profile:            lr.Profile,
+		Ladder:             ladder,
+		AudioLadder:        audioLadder,
+		TranscribeTrack:    lr.TranscribeTrack,
+		TranscribeLanguage: lr.TranscribeLanguage,
+		SegmentFormat:      segmentFormat,
+		Dash:               dash,
+		SinglePass:         lr.singlePass(),
+		PerTitle:           lr.perTitle(),
+		QualityReport:      lr.qualityReport(),
+		Thumbnails:         thumbnails,
+		Poster:             lr.poster(),
+	})
+
+	if err != nil {
+		log.Println(err)
+		os.Remove(videoFilename)
+		if errors.Is(err, queue.ErrQueueFull) {
+			return fiber.ErrServiceUnavailable
+		}
+		return fiber.ErrInternalServerError
+	}
+
+	statusUrl := fmt.Sprintf("%s/v1/transcode/job/%s", c.BaseURL(), r.Job.Id)
+	c.Set(fiber.HeaderLocation, statusUrl)
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"jobId":     r.Job.Id,
+		"status":    r.Status,
+		"statusUrl": statusUrl,
+	})
 }
 
 func (ta *transcodeApi) handleVideoTranscode() Handler {
 	return func(c *fiber.Ctx) error {
+		if isAsyncRequest(c) {
+			return ta.handleAsyncVideoTranscode(c)
+		}
+
+		if ta.draining.Load() {
+			return fiber.ErrServiceUnavailable
+		}
+
+		lr, err := parseTranscodeForm(c)
+		if err != nil {
+			return fiber.ErrBadRequest
+		}
+
+		ladder, audioLadder, err := lr.resolve()
+		if err != nil {
+			log.Println(err)
+			return fiber.ErrBadRequest
+		}
+
+		segmentFormat, dash, err := lr.output()
+		if err != nil {
+			log.Println(err)
+			return fiber.ErrBadRequest
+		}
+
+		thumbnails, err := lr.thumbnails()
+		if err != nil {
+			log.Println(err)
+			return fiber.ErrBadRequest
+		}
+
 		tmpDir, err := os.MkdirTemp("", uuid.NewString())
 
 		defer os.RemoveAll(tmpDir)
@@ -72,15 +442,35 @@ func (ta *transcodeApi) handleVideoTranscode() Handler {
 			return fiber.ErrInternalServerError
 		}
 
-		transcodedVideoMasterPlaylist, err := mediautils.TranscodeVideoToHLS(tmpVideoFilename, tmpDir)
+		transcodeResult, err := mediautils.TranscodeVideoToHLS(ta.api.Context(), tmpVideoFilename, tmpDir, mediautils.TranscodeOptions{
+			Ladder:        ladder,
+			AudioLadder:   audioLadder,
+			SegmentFormat: segmentFormat,
+			Dash:          dash,
+			SinglePass:    lr.singlePass(),
+			PerTitle:      lr.perTitle(),
+			QualityReport: lr.qualityReport(),
+			Thumbnails:    thumbnails,
+			Poster:        lr.poster(),
+			Probe:         data,
+		})
 		if err != nil {
 			log.Println(err)
 			return fiber.ErrInternalServerError
 		}
 
 		return c.JSON(fiber.Map{
-			"dir":           transcodedVideoMasterPlaylist,
-			"videoDuration": data.Format.DurationSeconds,
+			"dir":              transcodeResult.MasterPlaylistUrl,
+			"dash":             transcodeResult.DashManifestUrl,
+			"videoDuration":    data.Format.DurationSeconds,
+			"ladder":           transcodeResult.Ladder,
+			"complexity":       transcodeResult.Complexity,
+			"qualityReport":    transcodeResult.QualityReportUrl,
+			"quality":          transcodeResult.Quality,
+			"thumbnailTrack":   transcodeResult.ThumbnailTrackUrl,
+			"thumbnailSprites": transcodeResult.ThumbnailSpriteUrls,
+			"posterUrl":        transcodeResult.PosterUrl,
+			"thumbnails":       transcodeResult.PosterImages,
 		})
 	}
 }
@@ -119,41 +509,265 @@ func (ta *transcodeApi) handleVideoTranscodeJob() Handler {
 			return fiber.ErrBadRequest
 		}
 
-		j, err := jobService.GetJob(jobId)
+		if ta.draining.Load() {
+			return fiber.ErrServiceUnavailable
+		}
+
+		// the body is optional, without it the default ladder is used
+		lr := transcodeRequest{}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&lr); err != nil {
+				return fiber.ErrBadRequest
+			}
+		}
+
+		ladder, audioLadder, err := lr.resolve()
+		if err != nil {
+			log.Println(err)
+			return fiber.ErrBadRequest
+		}
+
+		segmentFormat, dash, err := lr.output()
+		if err != nil {
+			log.Println(err)
+			return fiber.ErrBadRequest
+		}
+
+		thumbnails, err := lr.thumbnails()
+		if err != nil {
+			log.Println(err)
+			return fiber.ErrBadRequest
+		}
+
+		j, err := jobService.GetJob(c.UserContext(), jobId)
 
 		if err != nil {
 			log.Println(err)
 			return fiber.ErrNotFound
 		}
 
-		ta.jobCh <- *j
+		if _, err := ta.queue.Enqueue(*j, queue.Options{
+			Profile:            lr.Profile,
+			Ladder:             ladder,
+			AudioLadder:        audioLadder,
+			TranscribeTrack:    lr.TranscribeTrack,
+			TranscribeLanguage: lr.TranscribeLanguage,
+			SegmentFormat:      segmentFormat,
+			Dash:               dash,
+			SinglePass:         lr.singlePass(),
+			PerTitle:           lr.perTitle(),
+			QualityReport:      lr.qualityReport(),
+			Thumbnails:         thumbnails,
+			Poster:             lr.poster(),
+		}); err != nil {
+			log.Println(err)
+			if errors.Is(err, queue.ErrJobAlreadyQueued) {
+				return fiber.ErrConflict
+			}
+			if errors.Is(err, queue.ErrQueueFull) {
+				return fiber.ErrServiceUnavailable
+			}
+			return fiber.ErrInternalServerError
+		}
 
 		return nil
 	}
 }
 
+func (ta *transcodeApi) handleGetJob() Handler {
+	return func(c *fiber.Ctx) error {
+		jobId := c.Params(JOB_ID_PARAM)
+		if jobId == "" {
+			return fiber.ErrBadRequest
+		}
+
+		r, err := ta.queue.Get(jobId)
+		if err != nil {
+			log.Println(err)
+			if errors.Is(err, queue.ErrJobNotFound) {
+				return fiber.ErrNotFound
+			}
+			return fiber.ErrInternalServerError
+		}
+
+		return c.JSON(r)
+	}
+}
+
+func (ta *transcodeApi) handleGetJobProgress() Handler {
+	return func(c *fiber.Ctx) error {
+		jobId := c.Params(JOB_ID_PARAM)
+		if jobId == "" {
+			return fiber.ErrBadRequest
+		}
+
+		r, err := ta.queue.Get(jobId)
+		if err != nil {
+			log.Println(err)
+			if errors.Is(err, queue.ErrJobNotFound) {
+				return fiber.ErrNotFound
+			}
+			return fiber.ErrInternalServerError
+		}
+
+		percent := 0.0
+		renditions := map[string]float64{}
+
+		if p, ok := ta.progress.get(jobId); ok {
+			percent = p.Percent
+			renditions = p.Renditions
+		} else if r.Status == job.StatusDone {
+			percent = 100
+		}
+
+		return c.JSON(job.JobProgressRequest{
+			Id:         jobId,
+			Stage:      r.Stage,
+			Percent:    percent,
+			Renditions: renditions,
+		})
+	}
+}
+
+func (ta *transcodeApi) handleCancelJob() Handler {
+	js := job.NewJobService()
+	return func(c *fiber.Ctx) error {
+		jobId := c.Params(JOB_ID_PARAM)
+		if jobId == "" {
+			return fiber.ErrBadRequest
+		}
+
+		r, err := ta.queue.CancelPending(jobId)
+		if err == nil {
+			if r.Options.Upload != nil {
+				os.Remove(r.Options.Upload.FilePath)
+			}
+			go newJobNotifier(js, r).Cancelled(context.Background(), jobId)
+			return c.SendStatus(fiber.StatusOK)
+		}
+
+		if errors.Is(err, queue.ErrJobNotFound) {
+			return fiber.ErrNotFound
+		}
+
+		if !errors.Is(err, queue.ErrJobNotPending) {
+			log.Println(err)
+			return fiber.ErrInternalServerError
+		}
+
+		// the job is already running, the worker reports the cancellation once ffmpeg has stopped
+		if ta.pool.Cancel(jobId) {
+			return c.SendStatus(fiber.StatusAccepted)
+		}
+
+		return fiber.ErrConflict
+	}
+}
+
+func (ta *transcodeApi) handleListJobs() Handler {
+	return func(c *fiber.Ctx) error {
+		records, err := ta.queue.List(c.Query("status"), c.QueryInt("limit", 50))
+		if err != nil {
+			log.Println(err)
+			return fiber.ErrInternalServerError
+		}
+
+		return c.JSON(fiber.Map{
+			"jobs": records,
+		})
+	}
+}
+
+func (ta *transcodeApi) handleGetWorkers() Handler {
+	return func(c *fiber.Ctx) error {
+		depth, err := ta.queue.Depth()
+		if err != nil {
+			log.Println(err)
+			return fiber.ErrInternalServerError
+		}
+
+		return c.JSON(fiber.Map{
+			"workers":    ta.pool.Statuses(),
+			"queueDepth": depth,
+		})
+	}
+}
+
 func (ta *transcodeApi) handleJobs() {
 	js := job.NewJobService()
 
-	go func() {
-		transcodeJobLock := new(sync.Mutex)
-		for j := range ta.jobCh {
-			go func(j job.Job, jLock *sync.Mutex) {
-				jLock.Lock()
-				defer jLock.Unlock()
-				if err := ta.runTranscodeJob(js, j); err != nil {
-					log.Println(err)
-					js.SendJobProcessingFailedWebhook(j.Id, err)
-				}
-			}(j, transcodeJobLock)
+	ta.pool = worker.NewPool(ta.queue, internal.Env.TranscodeWorkerCount, func(ctx context.Context, r *queue.Record) error {
+		n := newJobNotifier(js, r)
+		ta.progress.track(ctx, r.Job.Id, n)
+		defer ta.progress.remove(r.Job.Id)
+		if err := ta.runTranscodeJob(ctx, n, r); err != nil {
+			log.Println(err)
+			// the job context may be done by now, the outcome is still reported
+			if errors.Is(context.Cause(ctx), worker.ErrJobCancelled) {
+				n.Cancelled(context.Background(), r.Job.Id)
+			} else if ta.willResume(ctx) {
+				log.Printf("job %s interrupted by shutdown, it will resume on the next boot\n", r.Job.Id)
+			} else if errors.Is(context.Cause(ctx), worker.ErrShuttingDown) {
+				n.Failed(context.Background(), r.Job.Id, worker.ErrShuttingDown, retry.Attempts(err))
+			} else {
+				n.Failed(context.Background(), r.Job.Id, err, retry.Attempts(err))
+			}
+			return err
 		}
-	}()
+		return nil
+	})
+
+	ta.pool.Start(context.Background())
 }
 
-func (ta *transcodeApi) runTranscodeJob(js *job.JobService, j job.Job) error {
-	go js.SendJobProcessingStartedWebhook(j.Id)
+// willResume reports whether a job interrupted by shutdown is put back in the queue,
+// in which case its source video must be kept around
+func (ta *transcodeApi) willResume(ctx context.Context) bool {
+	return internal.Env.ShutdownRequeueJobs && errors.Is(context.Cause(ctx), worker.ErrShuttingDown)
+}
+
+func (ta *transcodeApi) setJobStage(jobId, stage, detail string) {
+	if err := ta.queue.SetStage(jobId, stage, detail); err != nil {
+		log.Println(err)
+	}
+}
+
+// fetchSourceVideo returns the local path of the video to transcode and a cleanup func to call once the job is over,
+// which also deletes the original video unless it is still needed to resume the job
+func (ta *transcodeApi) fetchSourceVideo(ctx context.Context, s3Client *s3.S3Client, r *queue.Record) (string, func(deleteOriginal bool), error) {
+	if r.Options.Upload != nil {
+		return r.Options.Upload.FilePath, func(deleteOriginal bool) {
+			if deleteOriginal {
+				os.Remove(r.Options.Upload.FilePath)
+			}
+		}, nil
+	}
+
+	ta.setJobStage(r.Job.Id, queue.StageDownloading, "")
+	var file *os.File
+	err := retry.Do(ctx, retry.StepDownload, retry.PolicyFor(retry.StepDownload), func(ctx context.Context) error {
+		var err error
+		file, err = s3Client.GetObject(ctx, r.Job.VideoUrl)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return file.Name(), func(deleteOriginal bool) {
+		file.Close()
+		os.Remove(file.Name())
+		// the job context is usually done by the time the job is cleaned up
+		if deleteOriginal {
+			s3Client.DeleteObject(context.Background(), r.Job.VideoUrl)
+		}
+	}, nil
+}
+
+func (ta *transcodeApi) runTranscodeJob(ctx context.Context, n jobNotifier, r *queue.Record) error {
+	j := r.Job
+	go n.Started(ctx, j.Id)
 
-	ctx := context.Context(context.Background())
 	s3Client := s3.NewS3Client()
 
 	if j.Status != "pending" {
@@ -162,21 +776,27 @@ func (ta *transcodeApi) runTranscodeJob(js *job.JobService, j job.Job) error {
 		return err
 	}
 
-	file, err := s3Client.GetObject(ctx, j.VideoUrl)
+	videoFileName, cleanupSource, err := ta.fetchSourceVideo(ctx, s3Client, r)
 	if err != nil {
-		go js.SendJobProcessingFailedWebhook(j.Id, err)
 		log.Println(err)
 		return err
 	}
 
-	defer file.Close()
-	defer os.Remove(file.Name())
-	defer s3Client.DeleteObject(ctx, j.VideoUrl)
+	defer func() {
+		cleanupSource(!ta.willResume(ctx))
+	}()
 
-	data, err := ffprobe.GetProbeData(file.Name(), 120000*time.Millisecond)
+	ta.setJobStage(j.Id, queue.StageProbing, "")
+	var data *ffprobe.ProbeData
+	err = retry.Do(ctx, retry.StepProbe, retry.PolicyFor(retry.StepProbe), func(ctx context.Context) error {
+		probeCtx, cancelProbe := context.WithTimeout(ctx, 120000*time.Millisecond)
+		defer cancelProbe()
+		var err error
+		data, err = ffprobe.GetProbeDataContext(probeCtx, videoFileName)
+		return err
+	})
 
 	if err != nil {
-		go js.SendJobProcessingFailedWebhook(j.Id, err)
 		log.Println(err)
 		return err
 	}
@@ -184,47 +804,148 @@ func (ta *transcodeApi) runTranscodeJob(js *job.JobService, j job.Job) error {
 	tmpDir, err := os.MkdirTemp("", uuid.NewString())
 
 	if err != nil {
-		go js.SendJobProcessingFailedWebhook(j.Id, err)
 		log.Println(err)
 		return err
 	}
 
+	defer os.RemoveAll(tmpDir)
+
+	// objects uploaded so far, removed again if the job is cancelled before completion. Both branches record
+	// their uploads as soon as they happen, as the other branch may still be running when the job is cancelled
+	uploadedKeys := []string{}
+	var uploadedKeysLock sync.Mutex
+	recordUpload := func(key string) {
+		uploadedKeysLock.Lock()
+		defer uploadedKeysLock.Unlock()
+		uploadedKeys = append(uploadedKeys, key)
+	}
+	defer func() {
+		if ctx.Err() != nil {
+			uploadedKeysLock.Lock()
+			defer uploadedKeysLock.Unlock()
+			removeUploadedObjects(s3Client, uploadedKeys)
+		}
+	}()
+
+	// a failure in either branch stops the other one as well
+	branchCtx, cancelBranches := context.WithCancel(ctx)
+	defer cancelBranches()
+
+	// uploaded files are only transcribed when the caller asks for it
+	transcribe := r.Options.Upload == nil || r.Options.Upload.Transcribe
+
 	var wg sync.WaitGroup
 	wg.Add(2)
-	errCh := make(chan error)
-	transcodedVideoMasterPlaylist := ""
+	errCh := make(chan error, 2)
+	var transcodeResult *mediautils.TranscodeResult
 
 	subtitleTracks := []openai.SubtitleTrack{}
-	go func(wg *sync.WaitGroup, videoDirectory *string) {
+	go func(wg *sync.WaitGroup, videoResult **mediautils.TranscodeResult) {
 		defer wg.Done()
-		transcodedVideoMasterPlaylist, err := mediautils.TranscodeVideoToHLS(file.Name(), tmpDir)
+		var transcodeResult *mediautils.TranscodeResult
+		err := retry.Do(branchCtx, retry.StepTranscode, retry.PolicyFor(retry.StepTranscode), func(ctx context.Context) error {
+			var err error
+			transcodeResult, err = mediautils.TranscodeVideoToHLS(ctx, videoFileName, tmpDir, mediautils.TranscodeOptions{
+				Duration:      data.Format.DurationSeconds,
+				Ladder:        r.Options.Ladder,
+				AudioLadder:   r.Options.AudioLadder,
+				SegmentFormat: r.Options.SegmentFormat,
+				Dash:          r.Options.Dash,
+				SinglePass:    r.Options.SinglePass,
+				PerTitle:      r.Options.PerTitle,
+				QualityReport: r.Options.QualityReport,
+				Thumbnails:    r.Options.Thumbnails,
+				Poster:        r.Options.Poster,
+				Probe:         data,
+				OnAnalysisStart: func() {
+					ta.setJobStage(j.Id, queue.StageTranscoding, "complexity analysis")
+				},
+				OnQualityStart: func() {
+					ta.setJobStage(j.Id, queue.StageTranscoding, "quality metrics")
+				},
+				OnThumbnailStart: func() {
+					ta.setJobStage(j.Id, queue.StageTranscoding, "thumbnails")
+				},
+				OnPosterStart: func() {
+					ta.setJobStage(j.Id, queue.StageTranscoding, "poster")
+				},
+				OnRenditionStart: func(rendition mediautils.Rendition) {
+					ta.setJobStage(j.Id, queue.StageTranscoding, "rendition "+rendition.Name)
+					ta.progress.update(j.Id, rendition.Name, 0)
+				},
+				OnRenditionProgress: func(rendition mediautils.Rendition, percent float64) {
+					ta.progress.update(j.Id, rendition.Name, percent)
+				},
+				OnUploadStart: func() {
+					ta.setJobStage(j.Id, queue.StageUploading, "hls segments")
+				},
+			})
+			return err
+		})
 		if err != nil {
+			cancelBranches()
 			errCh <- err
+			return
 		}
-		*videoDirectory = transcodedVideoMasterPlaylist
-	}(&wg, &transcodedVideoMasterPlaylist)
+		recordUpload(filepath.Dir(s3.GetRelativePath(transcodeResult.MasterPlaylistUrl)) + "/")
+		*videoResult = transcodeResult
+	}(&wg, &transcodeResult)
 
 	go func(wg *sync.WaitGroup, subtitleTracks *[]openai.SubtitleTrack) {
 		defer wg.Done()
 
-		audioFileName, err := mediautils.ExtractAudio(file.Name())
+		if !transcribe {
+			return
+		}
 
+		audioTracks, err := mediautils.ProbeAudioTracks(branchCtx, videoFileName)
 		if err != nil {
-			log.Println(err)
+			cancelBranches()
+			errCh <- err
+			return
+		}
+
+		track, err := mediautils.ChooseAudioTrack(audioTracks, r.Options.TranscribeTrack, r.Options.TranscribeLanguage)
+		if err != nil {
+			cancelBranches()
+			errCh <- err
+			return
+		}
+
+		audioFileName, err := mediautils.ExtractAudio(branchCtx, videoFileName, track)
+
+		if err != nil {
+			cancelBranches()
 			errCh <- err
 			return
 		}
 
 		defer os.Remove(*audioFileName)
 
-		englishVTTFileName, err := openai.TranscribeAudio(*audioFileName, tmpDir)
+		ta.setJobStage(j.Id, queue.StageTranscribing, "")
+		englishVTTFileName := ""
+		err = retry.Do(branchCtx, retry.StepTranscribe, retry.PolicyFor(retry.StepTranscribe), func(ctx context.Context) error {
+			var err error
+			englishVTTFileName, err = openai.TranscribeAudio(ctx, *audioFileName, tmpDir)
+			return err
+		})
 		if err != nil {
+			cancelBranches()
 			errCh <- err
+			return
 		}
 
-		mandarinVTTFileName, err := openai.TranslateVTT(englishVTTFileName, openai.MandarinTranslationLanguage, tmpDir)
+		ta.setJobStage(j.Id, queue.StageTranslating, openai.MandarinTranslationLanguage)
+		mandarinVTTFileName := ""
+		err = retry.Do(branchCtx, retry.StepTranslate, retry.PolicyFor(retry.StepTranslate), func(ctx context.Context) error {
+			var err error
+			mandarinVTTFileName, err = openai.TranslateVTT(ctx, englishVTTFileName, openai.MandarinTranslationLanguage, tmpDir)
+			return err
+		})
 		if err != nil {
+			cancelBranches()
 			errCh <- err
+			return
 		}
 
 		*subtitleTracks = append(*subtitleTracks, openai.SubtitleTrack{
@@ -236,39 +957,70 @@ func (ta *transcodeApi) runTranscodeJob(js *job.JobService, j job.Job) error {
 		})
 	}(&wg, &subtitleTracks)
 
-	go func(wg *sync.WaitGroup) {
-		wg.Wait()
-		close(errCh)
-	}(&wg)
+	wg.Wait()
+	close(errCh)
 
 	for err := range errCh {
-		go js.SendJobProcessingFailedWebhook(j.Id, err)
 		log.Println(err)
 		return err
 	}
 
+	ta.setJobStage(j.Id, queue.StageUploading, "subtitle tracks")
 	resps, errs := utils.Parallelize(func(arg openai.SubtitleTrack) (openai.SubtitleTrack, error) {
-		key, err := s3Client.UploadObject(ctx, arg.Src, func(path string) string {
-			return filepath.Base(path)
+		var key *string
+		err := retry.Do(ctx, retry.StepUpload, retry.PolicyFor(retry.StepUpload), func(ctx context.Context) error {
+			var err error
+			key, err = s3Client.UploadObject(ctx, arg.Src, func(path string) string {
+				return filepath.Base(path)
+			})
+			return err
 		})
+		if err != nil {
+			return openai.SubtitleTrack{}, err
+		}
 		return openai.SubtitleTrack{
 			Src:      s3.GetAbsolutePath(*key),
 			Language: arg.Language,
-		}, err
+		}, nil
 	}, subtitleTracks...)
 
+	for _, track := range resps {
+		recordUpload(s3.GetRelativePath(track.Src))
+	}
+
 	if len(errs) > 0 {
-		go js.SendJobProcessingFailedWebhook(j.Id, errs[0])
 		log.Println(errs[0])
+		return errs[0]
+	}
+
+	result := &job.JobCompletionRequest{
+		Id:                j.Id,
+		Status:            job.StatusDone,
+		VideoUrl:          transcodeResult.MasterPlaylistUrl,
+		DashUrl:           transcodeResult.DashManifestUrl,
+		SubtitleTracks:    resps,
+		VideoDuration:     data.Format.DurationSeconds,
+		Ladder:            toJobLadder(transcodeResult.Ladder),
+		Complexity:        toJobComplexity(transcodeResult.Complexity),
+		QualityReportUrl:  transcodeResult.QualityReportUrl,
+		Quality:           toJobQuality(transcodeResult.Quality),
+		ThumbnailTrackUrl: transcodeResult.ThumbnailTrackUrl,
+		ThumbnailSprites:  transcodeResult.ThumbnailSpriteUrls,
+		PosterUrl:         transcodeResult.PosterUrl,
+		Thumbnails:        toJobImages(transcodeResult.PosterImages),
+	}
+
+	// last chance to honour a cancellation before the platform is told the job is done
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	if err := js.SendJobCompletionWebhook(&job.JobCompletionRequest{
-		Id:             j.Id,
-		Status:         job.StatusDone,
-		VideoUrl:       transcodedVideoMasterPlaylist,
-		SubtitleTracks: resps,
-		VideoDuration:  data.Format.DurationSeconds,
+	if err := ta.queue.SetResult(j.Id, result); err != nil {
+		log.Println(err)
+	}
+
+	if err := retry.Do(ctx, retry.StepCompletionWebhook, retry.PolicyFor(retry.StepCompletionWebhook), func(ctx context.Context) error {
+		return n.Completed(ctx, result)
 	}); err != nil {
 		log.Println(err)
 		return err
@@ -276,3 +1028,20 @@ func (ta *transcodeApi) runTranscodeJob(js *job.JobService, j job.Job) error {
 
 	return nil
 }
+
+// removeUploadedObjects deletes objects and directory prefixes (keys ending in "/") from s3,
+// using a fresh context since the job context is already cancelled at this point
+func removeUploadedObjects(s3Client *s3.S3Client, keys []string) {
+	ctx := context.Background()
+	for _, key := range keys {
+		var err error
+		if strings.HasSuffix(key, "/") {
+			err = s3Client.DeleteDirectory(ctx, key)
+		} else {
+			err = s3Client.DeleteObject(ctx, key)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
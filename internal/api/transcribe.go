@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
@@ -33,6 +34,7 @@ func (ta *transcribeApi) Setup() {
 
 func (ta *transcribeApi) getTranscribeAudioHandler() Handler {
 	return func(c *fiber.Ctx) error {
+		ctx := context.Context(context.Background())
 		tmpDir, err := os.MkdirTemp("", uuid.NewString())
 		if err != nil {
 			log.Println(err)
@@ -50,7 +52,28 @@ func (ta *transcribeApi) getTranscribeAudioHandler() Handler {
 
 		var audioFileName = tmpFileName
 		if strings.HasSuffix(tmpFileName, ".mp4") {
-			_audioFileName, err := mediautils.ExtractAudio(tmpFileName)
+			var trackIndex *int
+			if trackValue := c.FormValue("track"); trackValue != "" {
+				index, err := strconv.Atoi(trackValue)
+				if err != nil {
+					return fiber.ErrBadRequest
+				}
+				trackIndex = &index
+			}
+
+			audioTracks, err := mediautils.ProbeAudioTracks(ctx, tmpFileName)
+			if err != nil {
+				log.Println(err)
+				return fiber.ErrInternalServerError
+			}
+
+			track, err := mediautils.ChooseAudioTrack(audioTracks, trackIndex, c.FormValue("language"))
+			if err != nil {
+				log.Println(err)
+				return fiber.ErrBadRequest
+			}
+
+			_audioFileName, err := mediautils.ExtractAudio(ctx, tmpFileName, track)
 
 			if err != nil {
 				return fiber.ErrInternalServerError
@@ -58,14 +81,14 @@ func (ta *transcribeApi) getTranscribeAudioHandler() Handler {
 
 			audioFileName = *_audioFileName
 		}
-		englishVTTFileName, err := openai.TranscribeAudio(audioFileName, tmpDir)
+		englishVTTFileName, err := openai.TranscribeAudio(ctx, audioFileName, tmpDir)
 
 		if err != nil {
 			log.Println(err)
 			return fiber.ErrInternalServerError
 		}
 
-		mandarinVTTFileName, err := openai.TranslateVTT(englishVTTFileName, openai.MandarinTranslationLanguage, tmpDir)
+		mandarinVTTFileName, err := openai.TranslateVTT(ctx, englishVTTFileName, openai.MandarinTranslationLanguage, tmpDir)
 
 		if err != nil {
 			log.Println(err)
@@ -73,7 +96,6 @@ func (ta *transcribeApi) getTranscribeAudioHandler() Handler {
 		}
 
 		s3Client := s3.NewS3Client()
-		ctx := context.Context(context.Background())
 
 		resps, errs := utils.Parallelize(func(arg openai.SubtitleTrack) (openai.SubtitleTrack, error) {
 			key, err := s3Client.UploadObject(ctx, arg.Src, func(path string) string {
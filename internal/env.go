@@ -2,8 +2,10 @@ package internal
 
 import (
 	"log"
+	"strings"
 
 	"github.com/joho/godotenv"
+	"github.com/spf13/cast"
 	"github.com/zihaolam/golang-media-upload-server/internal/pkg/utils"
 )
 
@@ -21,6 +23,51 @@ type envVars struct {
 	VideoPlatformApiKey    string `validate:"required,min=1"`
 	VideoPlatformServerUrl string `validate:"required,min=1"`
 	SecretKey              string `validate:"required,min=1"`
+	JobQueuePath           string `validate:"required,min=1"`
+	JobQueueMaxDepth       int    `validate:"min=1"`
+	JobRetention           int    `validate:"min=0"`
+	TranscodeWorkerCount   int    `validate:"min=1"`
+	JobProgressInterval    int    `validate:"min=1"`
+	RetryMaxAttempts       int    `validate:"min=1"`
+	RetryInitialBackoff    int    `validate:"min=0"`
+	RetryMaxBackoff        int    `validate:"min=0"`
+	RetryStepMaxAttempts   intMap `validate:"dive,keys,oneof=download probe transcode transcribe translate upload completion_webhook,endkeys,min=1"`
+	UploadDir              string `validate:"required,min=1"`
+	ShutdownTimeout        int    `validate:"min=0"`
+	ShutdownRequeueJobs    bool
+	LadderConfigFile       string
+	SeparateAudio          bool
+	HLSSegmentFormat       string `validate:"oneof=ts fmp4"`
+	DashOutput             bool
+	SinglePassEncode       bool
+	PerTitleEncode         bool
+	QualityReport          bool
+	ThumbnailInterval      int    `validate:"min=0"`
+	ThumbnailFormat        string `validate:"oneof=jpeg png webp"`
+	Poster                 bool
+}
+
+func getEnvOrDefault(envFile map[string]string, key, defaultValue string) string {
+	if value, ok := envFile[key]; ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+type intMap map[string]int
+
+// parses "key=1,other=2" into a map, entries without a number are parsed as 0 so validation rejects them
+func parseIntMap(value string) intMap {
+	m := intMap{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, n, _ := strings.Cut(entry, "=")
+		m[strings.TrimSpace(key)] = cast.ToInt(strings.TrimSpace(n))
+	}
+	return m
 }
 
 func newEnvVars() *envVars {
@@ -43,6 +90,28 @@ func newEnvVars() *envVars {
 		VideoPlatformApiKey:    envFile["VIDEO_PLATFORM_API_KEY"],
 		VideoPlatformServerUrl: envFile["VIDEO_PLATFORM_SERVER_URL"],
 		SecretKey:              envFile["SECRET_KEY"],
+		JobQueuePath:           getEnvOrDefault(envFile, "JOB_QUEUE_PATH", "jobs.db"),
+		JobQueueMaxDepth:       cast.ToInt(getEnvOrDefault(envFile, "JOB_QUEUE_MAX_DEPTH", "100")),
+		JobRetention:           cast.ToInt(getEnvOrDefault(envFile, "JOB_RETENTION_HOURS", "168")),
+		TranscodeWorkerCount:   cast.ToInt(getEnvOrDefault(envFile, "TRANSCODE_WORKER_COUNT", "2")),
+		JobProgressInterval:    cast.ToInt(getEnvOrDefault(envFile, "JOB_PROGRESS_INTERVAL_SECONDS", "10")),
+		RetryMaxAttempts:       cast.ToInt(getEnvOrDefault(envFile, "RETRY_MAX_ATTEMPTS", "3")),
+		RetryInitialBackoff:    cast.ToInt(getEnvOrDefault(envFile, "RETRY_INITIAL_BACKOFF_MS", "1000")),
+		RetryMaxBackoff:        cast.ToInt(getEnvOrDefault(envFile, "RETRY_MAX_BACKOFF_MS", "30000")),
+		RetryStepMaxAttempts:   parseIntMap(envFile["RETRY_STEP_MAX_ATTEMPTS"]),
+		UploadDir:              getEnvOrDefault(envFile, "UPLOAD_DIR", "uploads"),
+		ShutdownTimeout:        cast.ToInt(getEnvOrDefault(envFile, "SHUTDOWN_TIMEOUT_SECONDS", "60")),
+		ShutdownRequeueJobs:    cast.ToBool(getEnvOrDefault(envFile, "SHUTDOWN_REQUEUE_JOBS", "true")),
+		LadderConfigFile:       envFile["LADDER_CONFIG_FILE"],
+		SeparateAudio:          cast.ToBool(getEnvOrDefault(envFile, "SEPARATE_AUDIO", "false")),
+		HLSSegmentFormat:       getEnvOrDefault(envFile, "HLS_SEGMENT_FORMAT", "ts"),
+		DashOutput:             cast.ToBool(getEnvOrDefault(envFile, "DASH_OUTPUT", "false")),
+		SinglePassEncode:       cast.ToBool(getEnvOrDefault(envFile, "SINGLE_PASS_ENCODE", "false")),
+		PerTitleEncode:         cast.ToBool(getEnvOrDefault(envFile, "PER_TITLE_ENCODE", "false")),
+		QualityReport:          cast.ToBool(getEnvOrDefault(envFile, "QUALITY_REPORT", "false")),
+		ThumbnailInterval:      cast.ToInt(getEnvOrDefault(envFile, "THUMBNAIL_INTERVAL_SECONDS", "10")),
+		ThumbnailFormat:        getEnvOrDefault(envFile, "THUMBNAIL_FORMAT", "jpeg"),
+		Poster:                 cast.ToBool(getEnvOrDefault(envFile, "POSTER", "true")),
 	}
 
 	if err := utils.Validate(config); err != nil {
@@ -52,4 +121,10 @@ func newEnvVars() *envVars {
 	return &config
 }
 
-var Env = newEnvVars()
+// Env is empty until LoadEnv is called on startup, so that packages can be imported without a .env
+var Env = &envVars{}
+
+// LoadEnv reads and validates the .env, it must run before anything reads Env
+func LoadEnv() {
+	Env = newEnvVars()
+}
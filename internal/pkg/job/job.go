@@ -2,9 +2,11 @@ package job
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/zihaolam/golang-media-upload-server/internal"
 	"github.com/zihaolam/golang-media-upload-server/internal/pkg/openai"
@@ -14,6 +16,11 @@ const StatusPending = "pending"
 const StatusProcessing = "processing"
 const StatusDone = "done"
 const StatusFailed = "failed"
+const StatusCancelled = "cancelled"
+
+// bounds every request to the video platform and callback urls, so that an unresponsive
+// endpoint cannot hold up a worker
+const requestTimeout = 30 * time.Second
 
 type JobService struct {
 	http *http.Client
@@ -21,12 +28,12 @@ type JobService struct {
 
 func NewJobService() *JobService {
 	return &JobService{
-		http: http.DefaultClient,
+		http: &http.Client{Timeout: requestTimeout},
 	}
 }
 
-func newVideoPlatformApiRequest(method, path string, body []byte) (*http.Request, error) {
-	req, err := http.NewRequest(method, getVideoPlatformServerUrl(path), bytes.NewBuffer(body))
+func newVideoPlatformApiRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, getVideoPlatformServerUrl(path), bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
@@ -39,22 +46,99 @@ func getVideoPlatformServerUrl(additionalPath string) string {
 	return fmt.Sprintf("%s/api/%s", internal.Env.VideoPlatformServerUrl, additionalPath)
 }
 
+// StatusError is returned when the video platform responds with a non-success status
+type StatusError struct {
+	Message    string
+	StatusCode int
+	Status     string
+}
+
+func newStatusError(message string, resp *http.Response) *StatusError {
+	return &StatusError{
+		Message:    message,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Message, e.Status)
+}
+
+func (e *StatusError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
 type Job struct {
 	Id       string `json:"id"`
 	Status   string `json:"status"`
 	VideoUrl string `json:"videoUrl"`
 }
 
+// Rendition is a rung of the ladder that was encoded
+type Rendition struct {
+	Name         string `json:"name"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	VideoBitRate string `json:"videoBitRate"`
+	AudioBitRate string `json:"audioBitRate"`
+	MaxRate      string `json:"maxRate,omitempty"`
+	BufSize      string `json:"bufSize,omitempty"`
+	Profile      string `json:"profile,omitempty"`
+	Codec        string `json:"codec,omitempty"`
+	RateControl  string `json:"rateControl,omitempty"`
+	CRF          int    `json:"crf,omitempty"`
+}
+
+type Complexity struct {
+	BitsPerPixel float64 `json:"bitsPerPixel"`
+	Factor       float64 `json:"factor"`
+}
+
+type RenditionQuality struct {
+	Rendition string   `json:"rendition"`
+	PSNR      float64  `json:"psnr"`
+	SSIM      float64  `json:"ssim"`
+	VMAF      *float64 `json:"vmaf,omitempty"`
+}
+
+type Image struct {
+	Url    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+}
+
 type JobCompletionRequest struct {
 	Id             string                 `json:"id"`
 	Status         string                 `json:"status"`
 	VideoUrl       string                 `json:"videoUrl"`
+	DashUrl        string                 `json:"dashUrl,omitempty"`
 	SubtitleTracks []openai.SubtitleTrack `json:"subtitleTracks"`
 	VideoDuration  float64                `json:"videoDuration"`
+	// renditions that were encoded, which differ from the requested ladder after pruning and per title encoding
+	Ladder     []Rendition `json:"ladder,omitempty"`
+	Complexity *Complexity `json:"complexity,omitempty"`
+	// mean quality scores of each rendition, the per clip scores are in the report
+	QualityReportUrl string             `json:"qualityReportUrl,omitempty"`
+	Quality          []RenditionQuality `json:"quality,omitempty"`
+	// WebVTT track of #xywh cues into the thumbnail sprites, for scrubbing previews
+	ThumbnailTrackUrl string   `json:"thumbnailTrackUrl,omitempty"`
+	ThumbnailSprites  []string `json:"thumbnailSprites,omitempty"`
+	// poster chosen among sampled frames, in every size and format in Thumbnails
+	PosterUrl  string  `json:"posterUrl,omitempty"`
+	Thumbnails []Image `json:"thumbnails,omitempty"`
 }
 
-func (j *JobService) GetJob(jobId string) (*Job, error) {
-	req, err := newVideoPlatformApiRequest("GET", "job/"+jobId, nil)
+type JobProgressRequest struct {
+	Id         string             `json:"id"`
+	Stage      string             `json:"stage"`
+	Percent    float64            `json:"percent"`
+	Renditions map[string]float64 `json:"renditions"`
+}
+
+func (j *JobService) GetJob(ctx context.Context, jobId string) (*Job, error) {
+	req, err := newVideoPlatformApiRequest(ctx, "GET", "job/"+jobId, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -66,7 +150,7 @@ func (j *JobService) GetJob(jobId string) (*Job, error) {
 	}
 
 	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
-		return nil, fmt.Errorf("failed to get job: %s", resp.Status)
+		return nil, newStatusError("failed to get job", resp)
 	}
 
 	job := Job{}
@@ -80,12 +164,12 @@ func (j *JobService) GetJob(jobId string) (*Job, error) {
 	return &job, nil
 }
 
-func (j *JobService) SendJobCompletionWebhook(job *JobCompletionRequest) error {
+func (j *JobService) SendJobCompletionWebhook(ctx context.Context, job *JobCompletionRequest) error {
 	jsonData, err := json.Marshal(job)
 	if err != nil {
 		return err
 	}
-	req, err := newVideoPlatformApiRequest("POST", "job", jsonData)
+	req, err := newVideoPlatformApiRequest(ctx, "POST", "job", jsonData)
 
 	if err != nil {
 		return err
@@ -98,14 +182,14 @@ func (j *JobService) SendJobCompletionWebhook(job *JobCompletionRequest) error {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to send job completion webhook: %s", resp.Status)
+		return newStatusError("failed to send job completion webhook", resp)
 	}
 
 	return nil
 }
 
-func (j *JobService) SendJobProcessingStartedWebhook(jobId string) error {
-	req, err := newVideoPlatformApiRequest("POST", "job/"+jobId+"/start", nil)
+func (j *JobService) SendJobProcessingStartedWebhook(ctx context.Context, jobId string) error {
+	req, err := newVideoPlatformApiRequest(ctx, "POST", "job/"+jobId+"/start", nil)
 
 	if err != nil {
 		return err
@@ -118,19 +202,46 @@ func (j *JobService) SendJobProcessingStartedWebhook(jobId string) error {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to start job processing: %s", resp.Status)
+		return newStatusError("failed to start job processing", resp)
 	}
 
 	return nil
 }
 
-func (j *JobService) SendJobProcessingFailedWebhook(jobId string, err error) error {
-	jsonData, err := json.Marshal(map[string]string{"error": err.Error()})
+func (j *JobService) SendJobProcessingFailedWebhook(ctx context.Context, jobId string, jobErr error, attempts int) error {
+	jsonData, err := json.Marshal(map[string]any{
+		"error":    jobErr.Error(),
+		"attempts": attempts,
+	})
+
+	if err != nil {
+		return err
+	}
+	req, err := newVideoPlatformApiRequest(ctx, "POST", "job/"+jobId+"/fail", jsonData)
 
 	if err != nil {
 		return err
 	}
-	req, err := newVideoPlatformApiRequest("POST", "job/"+jobId+"/fail", jsonData)
+
+	resp, err := j.http.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError("failed to send job processing failed webhook", resp)
+	}
+
+	return nil
+}
+
+func (j *JobService) SendJobProgressWebhook(ctx context.Context, progress *JobProgressRequest) error {
+	jsonData, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	req, err := newVideoPlatformApiRequest(ctx, "POST", "job/"+progress.Id+"/progress", jsonData)
 
 	if err != nil {
 		return err
@@ -142,8 +253,60 @@ func (j *JobService) SendJobProcessingFailedWebhook(jobId string, err error) err
 		return err
 	}
 
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError("failed to send job progress webhook", resp)
+	}
+
+	return nil
+}
+
+// SendCallback posts a job payload to a caller supplied url instead of the video platform
+func (j *JobService) SendCallback(ctx context.Context, url string, payload any) error {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := j.http.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
+		return newStatusError("failed to send job callback", resp)
+	}
+
+	return nil
+}
+
+func (j *JobService) SendJobCancelledWebhook(ctx context.Context, jobId string) error {
+	req, err := newVideoPlatformApiRequest(ctx, "POST", "job/"+jobId+"/cancel", nil)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := j.http.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to send job processing failed webhook: %s", resp.Status)
+		return newStatusError("failed to send job cancelled webhook", resp)
 	}
 
 	return nil
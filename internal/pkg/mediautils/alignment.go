@@ -0,0 +1,104 @@
+package mediautils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+	ffprobe "github.com/vansante/go-ffprobe"
+)
+
+// target duration of hls segments in seconds
+const hlsSegmentDuration = 10
+
+// segments of different playlists may differ by about an audio frame, anything more means
+// their boundaries do not line up
+const segmentDurationTolerance = 0.1
+
+var ErrSegmentsMisaligned = errors.New("segment boundaries differ between renditions")
+
+// sourceFrameRate returns the frame rate of the first video stream, or 0 if it is unknown
+func sourceFrameRate(probe *ffprobe.ProbeData) float64 {
+	if probe == nil {
+		return 0
+	}
+	stream := probe.GetFirstVideoStream()
+	if stream == nil {
+		return 0
+	}
+	if frameRate := parseFrameRate(stream.AvgFrameRate); frameRate > 0 {
+		return frameRate
+	}
+	return parseFrameRate(stream.RFrameRate)
+}
+
+// setKeyframeArgs places keyframes at the same timestamps in every rendition, with a fixed gop of one
+// segment and scene cut detection disabled, so that every segment starts with a keyframe and players
+// can switch renditions at any segment boundary
+func setKeyframeArgs(kwArgs ffmpeg.KwArgs, rendition Rendition, frameRate float64) {
+	kwArgs["force_key_frames"] = fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentDuration)
+
+	gop := ""
+	if frameRate > 0 {
+		gop = fmt.Sprintf("%d", int(math.Round(frameRate*hlsSegmentDuration)))
+		kwArgs["g"] = gop
+		kwArgs["keyint_min"] = gop
+	}
+
+	switch rendition.encoder {
+	case "libx265":
+		params := "scenecut=0"
+		if gop != "" {
+			params += ":keyint=" + gop + ":min-keyint=" + gop
+		}
+		kwArgs["x265-params"] = params
+	case "libsvtav1":
+		kwArgs["svtav1-params"] = "scd=0"
+	default:
+		kwArgs["sc_threshold"] = "0"
+	}
+}
+
+// verifySegmentAlignment checks that every video playlist has the same number of segments with the same
+// durations. Audio playlists are left out, as audio frames do not line up with video frames, and so is the
+// last segment, whose length depends on where each stream of the source ends
+func verifySegmentAlignment(hlsSegments *HLSSegmentOutput) error {
+	playlistFileNames := []string{}
+	for _, playlist := range hlsSegments.playlists {
+		playlistFileNames = append(playlistFileNames, playlist.OutputFileName)
+	}
+
+	var reference *mediaPlaylist
+	referenceFileName := ""
+	for _, playlistFileName := range playlistFileNames {
+		playlist, err := parseMediaPlaylist(playlistFileName)
+		if err != nil {
+			return err
+		}
+
+		if reference == nil {
+			reference = playlist
+			referenceFileName = playlistFileName
+			continue
+		}
+
+		if len(playlist.Segments) != len(reference.Segments) {
+			return fmt.Errorf("%w: %s has %d segments, %s has %d", ErrSegmentsMisaligned,
+				filepath.Base(playlistFileName), len(playlist.Segments), filepath.Base(referenceFileName), len(reference.Segments))
+		}
+
+		for i, segment := range playlist.Segments {
+			if i == len(playlist.Segments)-1 {
+				break
+			}
+			if math.Abs(segment.Duration-reference.Segments[i].Duration) > segmentDurationTolerance {
+				return fmt.Errorf("%w: segment %d of %s is %.3fs, %.3fs in %s", ErrSegmentsMisaligned,
+					i, filepath.Base(playlistFileName), segment.Duration, reference.Segments[i].Duration, filepath.Base(referenceFileName))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package mediautils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestPlaylist(t *testing.T, dir, name string, durations ...float64) string {
+	t.Helper()
+	content := "#EXTM3U\n"
+	for i, duration := range durations {
+		content += fmt.Sprintf("#EXTINF:%.6f,\n%s_%03d.ts\n", duration, name, i)
+	}
+	content += "#EXT-X-ENDLIST\n"
+
+	playlistFileName := filepath.Join(dir, name+".m3u8")
+	if err := os.WriteFile(playlistFileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return playlistFileName
+}
+
+func TestVerifySegmentAlignment(t *testing.T) {
+	tests := []struct {
+		name      string
+		video     [][]float64
+		audio     []float64
+		wantError error
+	}{
+		{
+			name:  "aligned",
+			video: [][]float64{{4, 4, 2.5}, {4, 4, 2.5}},
+		},
+		{
+			name:  "within tolerance",
+			video: [][]float64{{4, 4, 2.5}, {4.05, 3.95, 2.5}},
+		},
+		{
+			name:  "last segment is not compared",
+			video: [][]float64{{4, 4, 2.5}, {4, 4, 2.2}},
+		},
+		{
+			name:  "audio is not compared",
+			video: [][]float64{{4, 4, 2.5}, {4, 4, 2.5}},
+			audio: []float64{3.99, 4.02, 2.7},
+		},
+		{
+			name:      "misaligned boundary",
+			video:     [][]float64{{4, 4, 2.5}, {4.5, 3.5, 2.5}},
+			wantError: ErrSegmentsMisaligned,
+		},
+		{
+			name:      "different segment count",
+			video:     [][]float64{{4, 4, 2.5}, {4, 4, 2, 0.5}},
+			wantError: ErrSegmentsMisaligned,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			hlsSegments := &HLSSegmentOutput{}
+			for i, durations := range tt.video {
+				hlsSegments.playlists = append(hlsSegments.playlists, Playlist{
+					OutputFileName: writeTestPlaylist(t, dir, fmt.Sprintf("video_%d", i), durations...),
+				})
+			}
+			if tt.audio != nil {
+				hlsSegments.audioPlaylists = append(hlsSegments.audioPlaylists, AudioPlaylist{
+					OutputFileName: writeTestPlaylist(t, dir, "audio", tt.audio...),
+				})
+			}
+
+			err := verifySegmentAlignment(hlsSegments)
+			if !errors.Is(err, tt.wantError) {
+				t.Fatalf("got error %v, want %v", err, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package mediautils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+var ErrNoAudioTrack = errors.New("source has no audio track")
+var ErrUnknownAudioTrack = errors.New("unknown audio track")
+
+// AudioTrack is an audio stream of the source, such as the original mix, a dub or a commentary
+type AudioTrack struct {
+	// position among the audio streams of the source, as used in "0:a:N" stream specifiers
+	Index    int    `json:"index"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Default  bool   `json:"default"`
+}
+
+// Name is the human readable name of the track shown by players
+func (t AudioTrack) Name() string {
+	if t.Title != "" {
+		return t.Title
+	}
+	if t.Language != "" && t.Language != "und" {
+		return t.Language
+	}
+	return fmt.Sprintf("Track %d", t.Index+1)
+}
+
+type audioTrackProbe struct {
+	Streams []struct {
+		Tags struct {
+			Language string `json:"language"`
+			Title    string `json:"title"`
+		} `json:"tags"`
+		Disposition struct {
+			Default int `json:"default"`
+		} `json:"disposition"`
+	} `json:"streams"`
+}
+
+// ProbeAudioTracks lists the audio streams of a video along with their language and title tags,
+// which the ffprobe package does not expose. Exactly one track is marked as default when there are any
+func ProbeAudioTracks(ctx context.Context, videoFileName string) ([]AudioTrack, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "a",
+		"-show_entries", "stream_tags=language,title:stream_disposition=default",
+		"-of", "json",
+		videoFileName,
+	).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	probe := audioTrackProbe{}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, err
+	}
+
+	tracks := []AudioTrack{}
+	hasDefault := false
+	for i, stream := range probe.Streams {
+		isDefault := stream.Disposition.Default == 1 && !hasDefault
+		hasDefault = hasDefault || isDefault
+		tracks = append(tracks, AudioTrack{
+			Index:    i,
+			Language: stream.Tags.Language,
+			Title:    stream.Tags.Title,
+			Default:  isDefault,
+		})
+	}
+
+	if !hasDefault && len(tracks) > 0 {
+		tracks[0].Default = true
+	}
+
+	return tracks, nil
+}
+
+// ChooseAudioTrack returns the index of the track to use, picked by index if given,
+// otherwise by language if given, otherwise the default track
+func ChooseAudioTrack(tracks []AudioTrack, index *int, language string) (int, error) {
+	if len(tracks) == 0 {
+		return 0, ErrNoAudioTrack
+	}
+
+	if index != nil {
+		if *index < 0 || *index >= len(tracks) {
+			return 0, fmt.Errorf("%w: %d", ErrUnknownAudioTrack, *index)
+		}
+		return *index, nil
+	}
+
+	if language != "" {
+		for _, track := range tracks {
+			if strings.EqualFold(track.Language, language) {
+				return track.Index, nil
+			}
+		}
+		return 0, fmt.Errorf("%w: %s", ErrUnknownAudioTrack, language)
+	}
+
+	for _, track := range tracks {
+		if track.Default {
+			return track.Index, nil
+		}
+	}
+
+	return tracks[0].Index, nil
+}
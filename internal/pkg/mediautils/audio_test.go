@@ -0,0 +1,66 @@
+package mediautils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAudioTrackName(t *testing.T) {
+	tests := []struct {
+		track AudioTrack
+		want  string
+	}{
+		{track: AudioTrack{Index: 0, Language: "eng", Title: "Director's commentary"}, want: "Director's commentary"},
+		{track: AudioTrack{Index: 1, Language: "spa"}, want: "spa"},
+		{track: AudioTrack{Index: 2, Language: "und"}, want: "Track 3"},
+		{track: AudioTrack{Index: 0}, want: "Track 1"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.track.Name(); got != tt.want {
+			t.Errorf("Name() of %+v = %s, want %s", tt.track, got, tt.want)
+		}
+	}
+}
+
+func TestChooseAudioTrack(t *testing.T) {
+	tracks := []AudioTrack{
+		{Index: 0, Language: "eng"},
+		{Index: 1, Language: "fra", Default: true},
+		{Index: 2, Language: "spa"},
+	}
+	index := func(i int) *int {
+		return &i
+	}
+
+	tests := []struct {
+		name     string
+		tracks   []AudioTrack
+		index    *int
+		language string
+		want     int
+		wantErr  error
+	}{
+		{name: "default track", tracks: tracks, want: 1},
+		{name: "by index", tracks: tracks, index: index(2), want: 2},
+		{name: "index takes precedence over language", tracks: tracks, index: index(0), language: "spa", want: 0},
+		{name: "by language ignoring case", tracks: tracks, language: "SPA", want: 2},
+		{name: "first track without a default", tracks: []AudioTrack{{Index: 0}, {Index: 1}}, want: 0},
+		{name: "index out of range", tracks: tracks, index: index(3), wantErr: ErrUnknownAudioTrack},
+		{name: "negative index", tracks: tracks, index: index(-1), wantErr: ErrUnknownAudioTrack},
+		{name: "unknown language", tracks: tracks, language: "deu", wantErr: ErrUnknownAudioTrack},
+		{name: "no audio", tracks: nil, wantErr: ErrNoAudioTrack},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ChooseAudioTrack(tt.tracks, tt.index, tt.language)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got track %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
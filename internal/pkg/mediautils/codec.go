@@ -0,0 +1,115 @@
+package mediautils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const CODEC_H264 = "h264"
+const CODEC_HEVC = "hevc"
+const CODEC_AV1 = "av1"
+
+// encoders that can produce each codec, in order of preference
+var codecEncoders = map[string][]string{
+	CODEC_H264: {"h264"},
+	CODEC_HEVC: {"libx265"},
+	CODEC_AV1:  {"libsvtav1", "libaom-av1"},
+}
+
+var encodersLock sync.Mutex
+var encoders map[string]bool
+
+// availableEncoders lists the video encoders of the local ffmpeg build. A successful query is cached
+// for the life of the process, while a failed one is retried by the next caller. It runs detached from
+// the context of the job that happens to call it first, as the result is shared by every later job
+func availableEncoders() (map[string]bool, error) {
+	encodersLock.Lock()
+	defer encodersLock.Unlock()
+
+	if encoders != nil {
+		return encoders, nil
+	}
+
+	out, err := exec.CommandContext(context.Background(), "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	available := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// lines look like " V....D libx265              libx265 H.265 / HEVC"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "V") {
+			continue
+		}
+		available[fields[1]] = true
+	}
+	encoders = available
+
+	return encoders, nil
+}
+
+// videoEncoder returns the ffmpeg encoder for a codec, h264 when codec is empty
+func videoEncoder(codec string) (string, error) {
+	if codec == "" || codec == CODEC_H264 {
+		// resolved by ffmpeg itself, as it was before codecs became configurable
+		return "h264", nil
+	}
+
+	candidates, ok := codecEncoders[codec]
+	if !ok {
+		return "", fmt.Errorf("unsupported codec %s", codec)
+	}
+
+	available, err := availableEncoders()
+	if err != nil {
+		return "", err
+	}
+
+	for _, encoder := range candidates {
+		if available[encoder] {
+			return encoder, nil
+		}
+	}
+
+	return "", fmt.Errorf("no encoder for %s in the local ffmpeg build", codec)
+}
+
+// selectEncoders resolves the encoder of every rendition, skipping renditions whose codec the local
+// ffmpeg build cannot encode so that the h264 renditions remain as the fallback
+func selectEncoders(renditions []Rendition) ([]Rendition, error) {
+	selected := []Rendition{}
+
+	for _, rendition := range renditions {
+		encoder, err := videoEncoder(rendition.Codec)
+		if err != nil {
+			log.Printf("skipping rendition %s: %s\n", rendition.Name, err)
+			continue
+		}
+		rendition.encoder = encoder
+		selected = append(selected, rendition)
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("none of the renditions can be encoded by the local ffmpeg build")
+	}
+
+	return selected, nil
+}
+
+// requiresFMP4 reports whether any rendition uses a codec that hls only supports in fragmented mp4
+func requiresFMP4(renditions []Rendition) bool {
+	for _, rendition := range renditions {
+		if rendition.Codec == CODEC_HEVC || rendition.Codec == CODEC_AV1 {
+			return true
+		}
+	}
+	return false
+}
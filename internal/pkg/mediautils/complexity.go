@@ -0,0 +1,152 @@
+package mediautils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// number and length in seconds of the clips sampled across the source by the complexity analysis
+const complexitySampleCount = 3
+const complexitySampleDuration = 5
+
+// short side of the probe encodes, small enough to keep the analysis fast
+const complexityProbeHeight = 540
+
+// crf of the probe encodes, the resulting bitrate grows with the motion and detail of the source
+const complexityProbeCRF = 23
+
+// bits per pixel of typical camera content at the probe crf, which the static ladders are tuned for
+const referenceBitsPerPixel = 0.05
+
+// bounds of the factor applied to the static ladder, so that an unusual sample cannot starve or bloat a title
+const minComplexityFactor = 0.5
+const maxComplexityFactor = 2.0
+
+// ComplexityAnalysis is the result of the per title analysis of a source
+type ComplexityAnalysis struct {
+	// bits per pixel per frame of the probe encodes
+	BitsPerPixel float64 `json:"bitsPerPixel"`
+	// multiplier applied to the bitrates of the static ladder
+	Factor float64 `json:"factor"`
+}
+
+// sampleClip is an interval of the source in seconds
+type sampleClip struct {
+	Offset   float64 `json:"offset"`
+	Duration float64 `json:"duration"`
+}
+
+// sampleClips spreads count clips of length seconds evenly over the source, or samples it whole when it is too short
+func sampleClips(duration float64, count int, length float64) []sampleClip {
+	if duration <= float64(count)*length {
+		return []sampleClip{{Offset: 0, Duration: duration}}
+	}
+	clips := []sampleClip{}
+	for i := 1; i <= count; i++ {
+		clips = append(clips, sampleClip{
+			Offset:   duration*float64(i)/float64(count+1) - length/2,
+			Duration: length,
+		})
+	}
+	return clips
+}
+
+// AnalyzeComplexity encodes a few short clips of the source at a fixed crf with a fast preset
+// and compares their bitrate against typical content to estimate how hard the title is to encode
+func AnalyzeComplexity(ctx context.Context, videoFileName string, source SourceGeometry, duration, frameRate float64) (*ComplexityAnalysis, error) {
+	if duration <= 0 || frameRate <= 0 {
+		return nil, fmt.Errorf("unknown duration or frame rate of source")
+	}
+
+	probe := ScaleLadder([]Rendition{{Height: min(complexityProbeHeight, source.shortSide())}}, source)[0]
+
+	totalBits := 0.0
+	totalDuration := 0.0
+	for _, clip := range sampleClips(duration, complexitySampleCount, complexitySampleDuration) {
+		size, err := encodeComplexitySample(ctx, videoFileName, probe, clip)
+		if err != nil {
+			return nil, err
+		}
+
+		totalBits += float64(size * 8)
+		totalDuration += clip.Duration
+	}
+
+	bitsPerPixel := totalBits / (totalDuration * frameRate * float64(probe.Width*probe.Height))
+	if bitsPerPixel <= 0 {
+		return nil, fmt.Errorf("complexity probe produced no video")
+	}
+
+	return &ComplexityAnalysis{
+		BitsPerPixel: bitsPerPixel,
+		Factor:       max(minComplexityFactor, min(maxComplexityFactor, bitsPerPixel/referenceBitsPerPixel)),
+	}, nil
+}
+
+// encodeComplexitySample encodes a clip of the source at the probe crf and returns its size in bytes
+func encodeComplexitySample(ctx context.Context, videoFileName string, probe Rendition, clip sampleClip) (int64, error) {
+	sampleFileName := filepath.Join(os.TempDir(), "complexity-"+uuid.NewString()+".mp4")
+	defer os.Remove(sampleFileName)
+
+	stream := ffmpeg.Input(videoFileName, ffmpeg.KwArgs{
+		"ss": fmt.Sprintf("%.3f", clip.Offset),
+		"t":  fmt.Sprintf("%.3f", clip.Duration),
+	}).Output(sampleFileName, ffmpeg.KwArgs{
+		"an":     "",
+		"vf":     fmt.Sprintf("scale=%d:%d,setsar=1", probe.Width, probe.Height),
+		"c:v":    "h264",
+		"preset": "veryfast",
+		"crf":    fmt.Sprintf("%d", complexityProbeCRF),
+	})
+
+	if err := runFFmpeg(ctx, stream); err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(sampleFileName)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+func scaleBitRate(bitRate string, factor float64) string {
+	if bitRate == "" {
+		return ""
+	}
+	return formatBitRate(int(float64(ParseBitRate(bitRate)) * factor))
+}
+
+// ApplyComplexity scales the video bitrates of a ladder by the complexity factor of the title
+func ApplyComplexity(renditions []Rendition, analysis *ComplexityAnalysis) []Rendition {
+	scaled := make([]Rendition, 0, len(renditions))
+	for _, rendition := range renditions {
+		rendition.VideoBitRate = scaleBitRate(rendition.VideoBitRate, analysis.Factor)
+		rendition.MaxRate = scaleBitRate(rendition.MaxRate, analysis.Factor)
+		rendition.BufSize = scaleBitRate(rendition.BufSize, analysis.Factor)
+		scaled = append(scaled, rendition)
+	}
+	return scaled
+}
+
+// perTitleLadder adapts the ladder to the complexity of the source, keeping the static ladder when the analysis fails
+func perTitleLadder(ctx context.Context, renditions []Rendition, videoFileName string, source SourceGeometry, opts *TranscodeOptions) ([]Rendition, *ComplexityAnalysis) {
+	if opts.OnAnalysisStart != nil {
+		opts.OnAnalysisStart()
+	}
+
+	analysis, err := AnalyzeComplexity(ctx, videoFileName, source, opts.sourceDuration(), sourceFrameRate(opts.Probe))
+	if err != nil {
+		log.Printf("complexity analysis failed, using the static ladder: %s\n", err)
+		return renditions, nil
+	}
+
+	return ApplyComplexity(renditions, analysis), analysis
+}
@@ -0,0 +1,74 @@
+package mediautils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSampleClips(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration float64
+		count    int
+		length   float64
+		want     []sampleClip
+	}{
+		{
+			name:     "spread over the source",
+			duration: 40,
+			count:    3,
+			length:   4,
+			want: []sampleClip{
+				{Offset: 8, Duration: 4},
+				{Offset: 18, Duration: 4},
+				{Offset: 28, Duration: 4},
+			},
+		},
+		{
+			name:     "single clip in the middle",
+			duration: 60,
+			count:    1,
+			length:   10,
+			want:     []sampleClip{{Offset: 25, Duration: 10}},
+		},
+		{
+			name:     "whole source when too short",
+			duration: 12,
+			count:    3,
+			length:   5,
+			want:     []sampleClip{{Offset: 0, Duration: 12}},
+		},
+		{
+			name:     "whole source when exactly as long as the clips",
+			duration: 15,
+			count:    3,
+			length:   5,
+			want:     []sampleClip{{Offset: 0, Duration: 15}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sampleClips(tt.duration, tt.count, tt.length)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyComplexity(t *testing.T) {
+	ladder := []Rendition{
+		{Name: "720p", VideoBitRate: "2800k", MaxRate: "4200k"},
+		{Name: "1080p", VideoBitRate: "5000k"},
+	}
+
+	got := ApplyComplexity(ladder, &ComplexityAnalysis{Factor: 0.5})
+	want := []Rendition{
+		{Name: "720p", VideoBitRate: "1400k", MaxRate: "2100k"},
+		{Name: "1080p", VideoBitRate: "2500k"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
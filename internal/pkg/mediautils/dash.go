@@ -0,0 +1,224 @@
+package mediautils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+type mpd struct {
+	XMLName                   xml.Name  `xml:"MPD"`
+	Xmlns                     string    `xml:"xmlns,attr"`
+	Profiles                  string    `xml:"profiles,attr"`
+	Type                      string    `xml:"type,attr"`
+	MediaPresentationDuration string    `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string    `xml:"minBufferTime,attr"`
+	BaseURL                   string    `xml:"BaseURL,omitempty"`
+	Period                    mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Id             string             `xml:"id,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType      string              `xml:"contentType,attr"`
+	MimeType         string              `xml:"mimeType,attr"`
+	Lang             string              `xml:"lang,attr,omitempty"`
+	SegmentAlignment bool                `xml:"segmentAlignment,attr"`
+	Label            string              `xml:"Label,omitempty"`
+	Role             *mpdRole            `xml:"Role,omitempty"`
+	Representations  []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRole struct {
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdRepresentation struct {
+	Id          string         `xml:"id,attr"`
+	Bandwidth   int            `xml:"bandwidth,attr"`
+	Codecs      string         `xml:"codecs,attr,omitempty"`
+	Width       int            `xml:"width,attr,omitempty"`
+	Height      int            `xml:"height,attr,omitempty"`
+	FrameRate   string         `xml:"frameRate,attr,omitempty"`
+	SegmentList mpdSegmentList `xml:"SegmentList"`
+}
+
+type mpdSegmentList struct {
+	Timescale       int                `xml:"timescale,attr"`
+	Initialization  mpdInitialization  `xml:"Initialization"`
+	SegmentTimeline mpdSegmentTimeline `xml:"SegmentTimeline"`
+	SegmentURLs     []mpdSegmentURL    `xml:"SegmentURL"`
+}
+
+type mpdInitialization struct {
+	SourceURL string `xml:"sourceURL,attr"`
+}
+
+type mpdSegmentTimeline struct {
+	S []mpdS `xml:"S"`
+}
+
+type mpdS struct {
+	T int64 `xml:"t,attr"`
+	D int64 `xml:"d,attr"`
+}
+
+type mpdSegmentURL struct {
+	Media string `xml:"media,attr"`
+}
+
+// milliseconds, which is precise enough for segment boundaries
+const dashTimescale = 1000
+
+// dashSegmentList describes the fmp4 segments of a media playlist, returning the list and its total duration in seconds
+func dashSegmentList(playlistFileName string) (*mpdSegmentList, float64, error) {
+	playlist, err := parseMediaPlaylist(playlistFileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if playlist.InitUri == "" {
+		return nil, 0, fmt.Errorf("playlist %s has no init segment, dash requires fmp4 segments", playlistFileName)
+	}
+
+	segmentList := mpdSegmentList{
+		Timescale: dashTimescale,
+		Initialization: mpdInitialization{
+			SourceURL: filepath.Base(playlist.InitUri),
+		},
+	}
+
+	var t int64
+	var duration float64
+	for _, segment := range playlist.Segments {
+		d := int64(math.Round(segment.Duration * dashTimescale))
+		segmentList.SegmentTimeline.S = append(segmentList.SegmentTimeline.S, mpdS{T: t, D: d})
+		segmentList.SegmentURLs = append(segmentList.SegmentURLs, mpdSegmentURL{Media: filepath.Base(segment.Uri)})
+		t += d
+		duration += segment.Duration
+	}
+
+	return &segmentList, duration, nil
+}
+
+// dashDuration formats seconds as an xs:duration, e.g. PT12.345S
+func dashDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
+
+// generateDashManifest writes an mpd over the same fmp4 segments as the hls playlists, with segments
+// resolved against baseUrl. Each video codec and each audio track gets its own adaptation set, as
+// players only switch between representations of the same codec
+func generateDashManifest(hlsSegments *HLSSegmentOutput, baseUrl string) (string, error) {
+	adaptationSets := []mpdAdaptationSet{}
+
+	// video playlists are grouped by codec, in the order the codecs first appear in the ladder
+	videoSets := map[string]int{}
+	var duration float64
+	for _, playlist := range hlsSegments.playlists {
+		segmentList, playlistDuration, err := dashSegmentList(playlist.OutputFileName)
+		if err != nil {
+			return "", err
+		}
+		duration = math.Max(duration, playlistDuration)
+
+		representation := mpdRepresentation{
+			Id:          playlist.Rendition.Name,
+			Bandwidth:   playlist.Rendition.Bandwidth(),
+			Width:       playlist.Rendition.Width,
+			Height:      playlist.Rendition.Height,
+			SegmentList: *segmentList,
+		}
+		if playlist.Info != nil {
+			representation.Bandwidth = playlist.Info.PeakBandwidth
+			representation.Codecs = playlist.Info.Codecs
+			if playlist.Info.FrameRate > 0 {
+				representation.FrameRate = strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", playlist.Info.FrameRate), "0"), ".")
+			}
+		}
+
+		codec := playlist.Rendition.Codec
+		if codec == "" {
+			codec = CODEC_H264
+		}
+		i, ok := videoSets[codec]
+		if !ok {
+			adaptationSets = append(adaptationSets, mpdAdaptationSet{
+				ContentType:      "video",
+				MimeType:         "video/mp4",
+				SegmentAlignment: true,
+			})
+			i = len(adaptationSets) - 1
+			videoSets[codec] = i
+		}
+		adaptationSets[i].Representations = append(adaptationSets[i].Representations, representation)
+	}
+
+	// audio playlists are grouped by track, with one representation per bitrate
+	audioSets := map[int]int{}
+	for _, audioPlaylist := range hlsSegments.audioPlaylists {
+		segmentList, _, err := dashSegmentList(audioPlaylist.OutputFileName)
+		if err != nil {
+			return "", err
+		}
+
+		track := audioPlaylist.Track
+		i, ok := audioSets[track.Index]
+		if !ok {
+			audio := mpdAdaptationSet{
+				ContentType:      "audio",
+				MimeType:         "audio/mp4",
+				SegmentAlignment: true,
+				Label:            track.Name(),
+			}
+			if track.Language != "" && track.Language != "und" {
+				audio.Lang = track.Language
+			}
+			if track.Default {
+				audio.Role = &mpdRole{
+					SchemeIdUri: "urn:mpeg:dash:role:2011",
+					Value:       "main",
+				}
+			}
+			adaptationSets = append(adaptationSets, audio)
+			i = len(adaptationSets) - 1
+			audioSets[track.Index] = i
+		}
+
+		representation := mpdRepresentation{
+			Id:          strings.TrimSuffix(filepath.Base(audioPlaylist.OutputFileName), ".m3u8"),
+			Bandwidth:   ParseBitRate(audioPlaylist.Rendition.BitRate),
+			SegmentList: *segmentList,
+		}
+		if audioPlaylist.Info != nil {
+			representation.Bandwidth = audioPlaylist.Info.PeakBandwidth
+			representation.Codecs = audioPlaylist.Info.Codecs
+		}
+		adaptationSets[i].Representations = append(adaptationSets[i].Representations, representation)
+	}
+
+	manifest := mpd{
+		Xmlns:                     "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                  "urn:mpeg:dash:profile:isoff-main:2011",
+		Type:                      "static",
+		MediaPresentationDuration: dashDuration(duration),
+		MinBufferTime:             dashDuration(2),
+		BaseURL:                   baseUrl,
+		Period: mpdPeriod{
+			Id:             "0",
+			AdaptationSets: adaptationSets,
+		},
+	}
+
+	out, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return xml.Header + string(out) + "\n", nil
+}
@@ -0,0 +1,141 @@
+package mediautils
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writePlaylist(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	fileName := filepath.Join(dir, name)
+	if err := os.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestGenerateDashManifest(t *testing.T) {
+	dir := t.TempDir()
+	fmp4 := func(name string) string {
+		return writePlaylist(t, dir, name+".m3u8", `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-MAP:URI="`+name+`_init.mp4"
+#EXTINF:4.004,
+`+name+`_000.m4s
+#EXTINF:2.5,
+`+name+`_001.m4s
+#EXT-X-ENDLIST
+`)
+	}
+
+	output := &HLSSegmentOutput{
+		playlists: []Playlist{
+			{
+				Rendition:      Rendition{Name: "720p", Width: 1280, Height: 720, VideoBitRate: "2800k"},
+				OutputFileName: fmp4("720p"),
+				Info:           &PlaylistInfo{PeakBandwidth: 3100000, Codecs: "avc1.64001f", FrameRate: 29.97},
+			},
+			{
+				Rendition:      Rendition{Name: "720phevc", Width: 1280, Height: 720, VideoBitRate: "1800k", Codec: CODEC_HEVC},
+				OutputFileName: fmp4("720phevc"),
+			},
+			{
+				Rendition:      Rendition{Name: "1080p", Width: 1920, Height: 1080, VideoBitRate: "5000k", Codec: CODEC_H264},
+				OutputFileName: fmp4("1080p"),
+				Info:           &PlaylistInfo{PeakBandwidth: 5600000, Codecs: "avc1.640028", FrameRate: 30},
+			},
+		},
+		audioPlaylists: []AudioPlaylist{
+			{
+				Rendition:      AudioRendition{Name: "audio", BitRate: "128k"},
+				Track:          AudioTrack{Index: 0, Language: "eng", Default: true},
+				OutputFileName: fmp4("audio_eng"),
+			},
+			{
+				Rendition:      AudioRendition{Name: "audio", BitRate: "128k"},
+				Track:          AudioTrack{Index: 1, Language: "und", Title: "Commentary"},
+				OutputFileName: fmp4("audio_1"),
+			},
+		},
+	}
+
+	manifest, err := generateDashManifest(output, "https://cdn.example.com/video/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := mpd{}
+	if err := xml.Unmarshal([]byte(manifest), &got); err != nil {
+		t.Fatalf("manifest is not valid xml: %s\n%s", err, manifest)
+	}
+
+	if got.Type != "static" || got.MediaPresentationDuration != "PT6.504S" || got.BaseURL != "https://cdn.example.com/video/" {
+		t.Fatalf("got type %s, duration %s and base url %s", got.Type, got.MediaPresentationDuration, got.BaseURL)
+	}
+
+	sets := got.Period.AdaptationSets
+	if len(sets) != 4 {
+		t.Fatalf("got %d adaptation sets, want 4", len(sets))
+	}
+
+	// h264 renditions share a set ahead of hevc, as the codecs first appear in the ladder
+	ids := func(set mpdAdaptationSet) []string {
+		ids := []string{}
+		for _, representation := range set.Representations {
+			ids = append(ids, representation.Id)
+		}
+		return ids
+	}
+	for i, want := range [][]string{{"720p", "1080p"}, {"720phevc"}, {"audio_eng"}, {"audio_1"}} {
+		if !reflect.DeepEqual(ids(sets[i]), want) {
+			t.Errorf("adaptation set %d has representations %v, want %v", i, ids(sets[i]), want)
+		}
+	}
+
+	h264 := sets[0].Representations[0]
+	if h264.Bandwidth != 3100000 || h264.Codecs != "avc1.64001f" || h264.FrameRate != "29.97" {
+		t.Errorf("got bandwidth %d, codecs %s and frame rate %s from the measured info", h264.Bandwidth, h264.Codecs, h264.FrameRate)
+	}
+	if sets[0].Representations[1].FrameRate != "30" {
+		t.Errorf("got frame rate %s, want 30", sets[0].Representations[1].FrameRate)
+	}
+	if hevc := sets[1].Representations[0]; hevc.Bandwidth != output.playlists[1].Rendition.Bandwidth() || hevc.Codecs != "" {
+		t.Errorf("got bandwidth %d and codecs %q without measured info", hevc.Bandwidth, hevc.Codecs)
+	}
+
+	wantSegments := mpdSegmentList{
+		Timescale:       dashTimescale,
+		Initialization:  mpdInitialization{SourceURL: "720p_init.mp4"},
+		SegmentTimeline: mpdSegmentTimeline{S: []mpdS{{T: 0, D: 4004}, {T: 4004, D: 2500}}},
+		SegmentURLs:     []mpdSegmentURL{{Media: "720p_000.m4s"}, {Media: "720p_001.m4s"}},
+	}
+	if !reflect.DeepEqual(h264.SegmentList, wantSegments) {
+		t.Errorf("got segment list %+v, want %+v", h264.SegmentList, wantSegments)
+	}
+
+	if main := sets[2]; main.Lang != "eng" || main.Role == nil || main.Role.Value != "main" || main.Representations[0].Bandwidth != 128000 {
+		t.Errorf("got default audio set %+v", main)
+	}
+	if commentary := sets[3]; commentary.Lang != "" || commentary.Label != "Commentary" || commentary.Role != nil {
+		t.Errorf("got commentary audio set %+v", commentary)
+	}
+}
+
+func TestGenerateDashManifestRequiresFMP4(t *testing.T) {
+	dir := t.TempDir()
+	output := &HLSSegmentOutput{
+		playlists: []Playlist{
+			{
+				Rendition:      Rendition{Name: "720p", Width: 1280, Height: 720, VideoBitRate: "2800k"},
+				OutputFileName: writePlaylist(t, dir, "720p.m3u8", "#EXTM3U\n#EXTINF:4.000000,\n720p_000.ts\n#EXT-X-ENDLIST\n"),
+			},
+		},
+	}
+
+	if _, err := generateDashManifest(output, ""); err == nil {
+		t.Fatal("expected an error for mpeg-ts segments")
+	}
+}
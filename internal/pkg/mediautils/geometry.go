@@ -0,0 +1,143 @@
+package mediautils
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	ffprobe "github.com/vansante/go-ffprobe"
+)
+
+// SourceGeometry is the size a video is displayed at, after its sample aspect ratio and rotation are applied
+type SourceGeometry struct {
+	Width  int
+	Height int
+}
+
+func (g SourceGeometry) portrait() bool {
+	return g.Height > g.Width
+}
+
+func (g SourceGeometry) shortSide() int {
+	return min(g.Width, g.Height)
+}
+
+// NewSourceGeometry computes the display size of the first video stream, where rotation
+// is in degrees as reported by the display matrix side data
+func NewSourceGeometry(probe *ffprobe.ProbeData, rotation int) (SourceGeometry, bool) {
+	stream := probe.GetFirstVideoStream()
+	if stream == nil || stream.Width == 0 || stream.Height == 0 {
+		return SourceGeometry{}, false
+	}
+
+	width := float64(stream.Width)
+	height := float64(stream.Height)
+
+	// non square pixels are stretched horizontally when displayed
+	if num, den, ok := parseRatio(stream.SampleAspectRatio); ok && num != den {
+		width = width * float64(num) / float64(den)
+	}
+
+	// older muxers only write the rotate tag
+	if rotation == 0 {
+		rotation = stream.Tags.Rotate
+	}
+
+	switch ((rotation % 360) + 360) % 360 {
+	case 90, 270:
+		width, height = height, width
+	}
+
+	return SourceGeometry{
+		Width:  int(math.Round(width)),
+		Height: int(math.Round(height)),
+	}, true
+}
+
+// parseRatio parses ffprobe ratios such as "16:9", returning false for unknown ratios like "0:1"
+func parseRatio(ratio string) (int, int, bool) {
+	parts := strings.Split(ratio, ":")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	num, err := strconv.Atoi(parts[0])
+	if err != nil || num <= 0 {
+		return 0, 0, false
+	}
+	den, err := strconv.Atoi(parts[1])
+	if err != nil || den <= 0 {
+		return 0, 0, false
+	}
+
+	return num, den, true
+}
+
+// evenDimension rounds to the nearest even number, which h264 with yuv420p requires
+func evenDimension(size float64) int {
+	return max(int(math.Round(size/2))*2, 2)
+}
+
+// ScaleLadder sizes every rendition to the aspect ratio of the source, using the rendition
+// height as the length of the short side so that portrait videos get the same quality rungs
+func ScaleLadder(renditions []Rendition, source SourceGeometry) []Rendition {
+	scaled := make([]Rendition, 0, len(renditions))
+	for _, rendition := range renditions {
+		shortSide := float64(evenDimension(float64(rendition.Height)))
+		longSide := evenDimension(shortSide * float64(max(source.Width, source.Height)) / float64(source.shortSide()))
+
+		if source.portrait() {
+			rendition.Width = int(shortSide)
+			rendition.Height = longSide
+		} else {
+			rendition.Width = longSide
+			rendition.Height = int(shortSide)
+		}
+		scaled = append(scaled, rendition)
+	}
+	return scaled
+}
+
+type rotationProbe struct {
+	Streams []struct {
+		SideDataList []struct {
+			Rotation int `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+}
+
+// probeRotation reads the display matrix rotation of the first video stream, which the ffprobe
+// package does not expose. Videos recorded on phones are usually stored landscape with a rotation of 90 or -90
+func probeRotation(ctx context.Context, videoFileName string) int {
+	out, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream_side_data=rotation",
+		"-of", "json",
+		videoFileName,
+	).Output()
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+
+	probe := rotationProbe{}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		log.Println(err)
+		return 0
+	}
+
+	for _, stream := range probe.Streams {
+		for _, sideData := range stream.SideDataList {
+			if sideData.Rotation != 0 {
+				return sideData.Rotation
+			}
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,119 @@
+package mediautils
+
+import (
+	"testing"
+
+	ffprobe "github.com/vansante/go-ffprobe"
+)
+
+func TestNewSourceGeometry(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   *ffprobe.Stream
+		rotation int
+		want     SourceGeometry
+		wantOk   bool
+	}{
+		{
+			name:   "landscape",
+			stream: &ffprobe.Stream{CodecType: "video", Width: 1920, Height: 1080},
+			want:   SourceGeometry{Width: 1920, Height: 1080},
+			wantOk: true,
+		},
+		{
+			name:     "rotated by the display matrix",
+			stream:   &ffprobe.Stream{CodecType: "video", Width: 1920, Height: 1080},
+			rotation: -90,
+			want:     SourceGeometry{Width: 1080, Height: 1920},
+			wantOk:   true,
+		},
+		{
+			name:   "rotated by the rotate tag",
+			stream: &ffprobe.Stream{CodecType: "video", Width: 1920, Height: 1080, Tags: ffprobe.StreamTags{Rotate: 270}},
+			want:   SourceGeometry{Width: 1080, Height: 1920},
+			wantOk: true,
+		},
+		{
+			name:     "upside down",
+			stream:   &ffprobe.Stream{CodecType: "video", Width: 1920, Height: 1080},
+			rotation: 180,
+			want:     SourceGeometry{Width: 1920, Height: 1080},
+			wantOk:   true,
+		},
+		{
+			name:   "anamorphic",
+			stream: &ffprobe.Stream{CodecType: "video", Width: 720, Height: 576, SampleAspectRatio: "64:45"},
+			want:   SourceGeometry{Width: 1024, Height: 576},
+			wantOk: true,
+		},
+		{
+			name:   "unknown sample aspect ratio",
+			stream: &ffprobe.Stream{CodecType: "video", Width: 1280, Height: 720, SampleAspectRatio: "0:1"},
+			want:   SourceGeometry{Width: 1280, Height: 720},
+			wantOk: true,
+		},
+		{
+			name:   "audio only",
+			stream: &ffprobe.Stream{CodecType: "audio"},
+			wantOk: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe := &ffprobe.ProbeData{Streams: []*ffprobe.Stream{tt.stream}}
+			got, ok := NewSourceGeometry(probe, tt.rotation)
+			if ok != tt.wantOk || got != tt.want {
+				t.Fatalf("got %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestScaleLadder(t *testing.T) {
+	ladder := []Rendition{
+		{Name: "360p", Width: 640, Height: 360},
+		{Name: "720p", Width: 1280, Height: 720},
+	}
+
+	tests := []struct {
+		name   string
+		source SourceGeometry
+		want   [][2]int
+	}{
+		{
+			name:   "16:9",
+			source: SourceGeometry{Width: 1920, Height: 1080},
+			want:   [][2]int{{640, 360}, {1280, 720}},
+		},
+		{
+			name:   "portrait",
+			source: SourceGeometry{Width: 1080, Height: 1920},
+			want:   [][2]int{{360, 640}, {720, 1280}},
+		},
+		{
+			name:   "4:3",
+			source: SourceGeometry{Width: 1440, Height: 1080},
+			want:   [][2]int{{480, 360}, {960, 720}},
+		},
+		{
+			name:   "ultrawide rounds to even dimensions",
+			source: SourceGeometry{Width: 2560, Height: 1080},
+			want:   [][2]int{{854, 360}, {1706, 720}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ScaleLadder(ladder, tt.source)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d renditions, want %d", len(got), len(tt.want))
+			}
+			for i, rendition := range got {
+				if rendition.Width != tt.want[i][0] || rendition.Height != tt.want[i][1] {
+					t.Errorf("rendition %s is %s, want %dx%d", rendition.Name, rendition.Resolution(), tt.want[i][0], tt.want[i][1])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package mediautils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	fileutils "github.com/zihaolam/golang-media-upload-server/internal/pkg/file"
+)
+
+// IFramePlaylist is an I-frame only playlist of a rendition for trick play, whose byte ranges
+// point at the keyframes in the segments of the rendition
+type IFramePlaylist struct {
+	OutputFileName string
+	// peak and average bitrate of the I-frames alone in bits per second
+	PeakBandwidth    int
+	AverageBandwidth int
+}
+
+type videoPacket struct {
+	PtsTime float64
+	Pos     int64
+	Size    int64
+	Key     bool
+}
+
+type packetProbe struct {
+	Packets []struct {
+		PtsTime string `json:"pts_time"`
+		Pos     string `json:"pos"`
+		Size    string `json:"size"`
+		Flags   string `json:"flags"`
+	} `json:"packets"`
+}
+
+// iframe is a keyframe of a segment and its time from the start of the playlist, its byte range
+// always starts at the beginning of the segment file
+type iframe struct {
+	Uri    string
+	Length int64
+	Start  float64
+}
+
+// probeVideoPackets lists the packets of the first video stream ordered by their position in the file
+func probeVideoPackets(ctx context.Context, fileName string) ([]videoPacket, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,pos,size,flags",
+		"-of", "json",
+		fileName,
+	).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	probe := packetProbe{}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, err
+	}
+
+	packets := []videoPacket{}
+	for _, p := range probe.Packets {
+		pts, err := strconv.ParseFloat(p.PtsTime, 64)
+		if err != nil {
+			continue
+		}
+		pos, err := strconv.ParseInt(p.Pos, 10, 64)
+		if err != nil {
+			continue
+		}
+		size, _ := strconv.ParseInt(p.Size, 10, 64)
+		packets = append(packets, videoPacket{
+			PtsTime: pts,
+			Pos:     pos,
+			Size:    size,
+			Key:     strings.Contains(p.Flags, "K"),
+		})
+	}
+
+	sort.Slice(packets, func(i, j int) bool {
+		return packets[i].Pos < packets[j].Pos
+	})
+
+	return packets, nil
+}
+
+// segmentIFrame locates the keyframe a segment starts with. Keyframes are only forced at segment
+// boundaries, so there is one per segment. The byte range starts at the beginning of the segment, so that
+// it includes the PAT and PMT of mpeg-ts or the moof of fmp4, and ends with the keyframe. It returns the
+// length of the range and the time of the keyframe from the start of the segment
+func segmentIFrame(ctx context.Context, playlistFileName, initUri string, segment mediaSegment) (int64, float64, error) {
+	fileName := segmentFileName(playlistFileName, segment.Uri)
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var initSize int64
+	probeFileName := fileName
+	if initUri != "" {
+		// fmp4 media segments cannot be probed without their init segment
+		initInfo, err := os.Stat(segmentFileName(playlistFileName, initUri))
+		if err != nil {
+			return 0, 0, err
+		}
+		initSize = initInfo.Size()
+
+		probeFileName, err = joinInitSegment(playlistFileName, initUri, segment.Uri)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer os.Remove(probeFileName)
+	}
+
+	packets, err := probeVideoPackets(ctx, probeFileName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	length, start, err := keyframeRange(packets, info.Size(), initSize, initUri != "")
+	if err != nil {
+		return 0, 0, fmt.Errorf("segment %s %w", segment.Uri, err)
+	}
+
+	return length, start, nil
+}
+
+// keyframeRange computes the length of the byte range from the start of a segment to the end of its
+// keyframe, and the time of the keyframe from the start of the segment. The packets of fmp4 segments
+// were probed with the init segment in front of them, so their positions are offset by its size
+func keyframeRange(packets []videoPacket, segmentSize, initSize int64, fragmented bool) (int64, float64, error) {
+	if len(packets) == 0 {
+		return 0, 0, fmt.Errorf("has no video")
+	}
+
+	first := packets[0].PtsTime
+	key := -1
+	for i, packet := range packets {
+		first = math.Min(first, packet.PtsTime)
+		if packet.Key && (key == -1 || packet.PtsTime < packets[key].PtsTime) {
+			key = i
+		}
+	}
+	if key == -1 {
+		return 0, 0, fmt.Errorf("has no keyframe")
+	}
+
+	// mpeg-ts packets carry no length of their own, so the keyframe ends where the next video packet starts
+	end := packets[key].Pos + packets[key].Size - initSize
+	if !fragmented {
+		end = segmentSize
+		if key+1 < len(packets) {
+			end = packets[key+1].Pos
+		}
+	}
+
+	return end, packets[key].PtsTime - first, nil
+}
+
+// generateIFramePlaylist writes the I-frame only playlist of a rendition next to its media playlist
+func generateIFramePlaylist(ctx context.Context, playlist Playlist) (*IFramePlaylist, error) {
+	media, err := parseMediaPlaylist(playlist.OutputFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	iframes := []iframe{}
+	segmentStart := 0.0
+	for _, segment := range media.Segments {
+		length, start, err := segmentIFrame(ctx, playlist.OutputFileName, media.InitUri, segment)
+		if err != nil {
+			return nil, err
+		}
+
+		iframes = append(iframes, iframe{
+			Uri:    segment.Uri,
+			Length: length,
+			Start:  segmentStart + start,
+		})
+		segmentStart += segment.Duration
+	}
+
+	if len(iframes) == 0 {
+		return nil, fmt.Errorf("playlist %s has no segments", playlist.OutputFileName)
+	}
+	if segmentStart <= 0 {
+		return nil, fmt.Errorf("segments of playlist %s have no duration", playlist.OutputFileName)
+	}
+
+	// every I-frame is shown until the next one
+	durations := make([]float64, len(iframes))
+	targetDuration := 0.0
+	var peak, totalBits float64
+	for i, frame := range iframes {
+		end := segmentStart
+		if i+1 < len(iframes) {
+			end = iframes[i+1].Start
+		}
+		durations[i] = end - frame.Start
+		targetDuration = math.Max(targetDuration, durations[i])
+
+		bits := float64(frame.Length * 8)
+		totalBits += bits
+		if durations[i] > 0 {
+			peak = math.Max(peak, bits/durations[i])
+		}
+	}
+
+	content := "#EXTM3U\n"
+	content += "#EXT-X-VERSION:4\n"
+	content += fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	content += "#EXT-X-MEDIA-SEQUENCE:0\n"
+	content += "#EXT-X-PLAYLIST-TYPE:VOD\n"
+	content += "#EXT-X-I-FRAMES-ONLY\n"
+	if media.InitUri != "" {
+		content += fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", media.InitUri)
+	}
+	for i, frame := range iframes {
+		content += fmt.Sprintf("#EXTINF:%.6f,\n#EXT-X-BYTERANGE:%d@0\n%s\n", durations[i], frame.Length, frame.Uri)
+	}
+	content += "#EXT-X-ENDLIST\n"
+
+	outputFileName := strings.Replace(playlist.OutputFileName, ".m3u8", "_iframes.m3u8", 1)
+	if err := fileutils.WriteToFile(outputFileName, content); err != nil {
+		return nil, err
+	}
+
+	return &IFramePlaylist{
+		OutputFileName:   outputFileName,
+		PeakBandwidth:    int(math.Ceil(peak)),
+		AverageBandwidth: int(math.Ceil(totalBits / segmentStart)),
+	}, nil
+}
+
+// iframeStreamInf advertises the I-frame playlist of a rendition in the master playlist
+func iframeStreamInf(playlist Playlist, outputDir string) string {
+	attributes := []string{
+		fmt.Sprintf("BANDWIDTH=%d", playlist.IFrames.PeakBandwidth),
+		fmt.Sprintf("AVERAGE-BANDWIDTH=%d", playlist.IFrames.AverageBandwidth),
+		"RESOLUTION=" + playlist.Rendition.Resolution(),
+	}
+
+	if playlist.Info != nil && playlist.Info.VideoCodec != "" {
+		attributes = append(attributes, fmt.Sprintf("CODECS=\"%s\"", playlist.Info.VideoCodec))
+	}
+
+	playlistFileName := strings.Replace(playlist.IFrames.OutputFileName, outputDir+"/", "", 1)
+	attributes = append(attributes, fmt.Sprintf("URI=\"%s\"", playlistFileName))
+
+	return "#EXT-X-I-FRAME-STREAM-INF:" + strings.Join(attributes, ",")
+}
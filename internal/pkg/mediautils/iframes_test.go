@@ -0,0 +1,87 @@
+package mediautils
+
+import (
+	"math"
+	"testing"
+)
+
+func TestKeyframeRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		packets     []videoPacket
+		segmentSize int64
+		initSize    int64
+		fragmented  bool
+		wantLength  int64
+		wantStart   float64
+		wantErr     bool
+	}{
+		{
+			name: "mpeg-ts keyframe ends at the next packet",
+			packets: []videoPacket{
+				{PtsTime: 10.0, Pos: 564, Size: 40000, Key: true},
+				{PtsTime: 10.04, Pos: 41172, Size: 3000},
+				{PtsTime: 10.08, Pos: 44556, Size: 2500},
+			},
+			segmentSize: 60000,
+			wantLength:  41172,
+			wantStart:   0,
+		},
+		{
+			name: "mpeg-ts segment of a single frame",
+			packets: []videoPacket{
+				{PtsTime: 4.0, Pos: 564, Size: 40000, Key: true},
+			},
+			segmentSize: 41360,
+			wantLength:  41360,
+			wantStart:   0,
+		},
+		{
+			name: "keyframe after reordered frames",
+			packets: []videoPacket{
+				{PtsTime: 8.08, Pos: 564, Size: 2000},
+				{PtsTime: 8.12, Pos: 2820, Size: 38000, Key: true},
+				{PtsTime: 8.0, Pos: 41548, Size: 2000},
+			},
+			segmentSize: 50000,
+			wantLength:  41548,
+			wantStart:   0.12,
+		},
+		{
+			name: "fmp4 positions include the init segment",
+			packets: []videoPacket{
+				{PtsTime: 2.0, Pos: 1800, Size: 30000, Key: true},
+				{PtsTime: 2.04, Pos: 31800, Size: 2000},
+			},
+			segmentSize: 40000,
+			initSize:    800,
+			fragmented:  true,
+			wantLength:  31000,
+			wantStart:   0,
+		},
+		{
+			name:    "no video",
+			wantErr: true,
+		},
+		{
+			name: "no keyframe",
+			packets: []videoPacket{
+				{PtsTime: 2.0, Pos: 564, Size: 2000},
+			},
+			segmentSize: 3000,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			length, start, err := keyframeRange(tt.packets, tt.segmentSize, tt.initSize, tt.fragmented)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if length != tt.wantLength || math.Abs(start-tt.wantStart) > 1e-9 {
+				t.Fatalf("got length %d at %v, want %d at %v", length, start, tt.wantLength, tt.wantStart)
+			}
+		})
+	}
+}
@@ -0,0 +1,443 @@
+package mediautils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	ffprobe "github.com/vansante/go-ffprobe"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/utils"
+)
+
+const LADDER_MOBILE = "mobile"
+const LADDER_STANDARD = "standard"
+const LADDER_PREMIUM_1080P = "premium-1080p"
+const LADDER_MULTICODEC_1080P = "multicodec-1080p"
+
+var ErrUnknownLadder = errors.New("unknown ladder profile")
+
+// Rendition is a single rung of an adaptive bitrate ladder
+type Rendition struct {
+	Name         string `json:"name" validate:"required,alphanum,max=32"`
+	Width        int    `json:"width" validate:"required,min=2"`
+	Height       int    `json:"height" validate:"required,min=2"`
+	VideoBitRate string `json:"videoBitRate" validate:"required"`
+	AudioBitRate string `json:"audioBitRate" validate:"required"`
+	MaxRate      string `json:"maxRate,omitempty"`
+	BufSize      string `json:"bufSize,omitempty"`
+	// encoder profile, e.g. baseline, main or high for h264
+	Profile string `json:"profile,omitempty"`
+	// CODEC_H264, CODEC_HEVC or CODEC_AV1, h264 when empty
+	Codec string `json:"codec,omitempty" validate:"omitempty,oneof=h264 hevc av1"`
+	// RATE_CONTROL_CAPPED_CRF, RATE_CONTROL_VBR or RATE_CONTROL_TWO_PASS, vbr when empty
+	RateControl string `json:"rateControl,omitempty" validate:"omitempty,oneof=crf vbr 2pass"`
+	// quality of capped crf, a codec specific default is used when 0
+	CRF int `json:"crf,omitempty" validate:"min=0,max=63"`
+	// ffmpeg encoder resolved for Codec
+	encoder string
+}
+
+// AudioRendition is an audio only rendition that video renditions reference through an audio group
+type AudioRendition struct {
+	Name    string `json:"name" validate:"required,alphanum,max=32"`
+	BitRate string `json:"bitRate" validate:"required"`
+}
+
+func (a AudioRendition) GroupId() string {
+	return "audio-" + a.Name
+}
+
+func (r Rendition) Resolution() string {
+	return fmt.Sprintf("%dx%d", r.Width, r.Height)
+}
+
+// Bandwidth estimates the peak bits per second of the rendition with 20% headroom over the target bitrates
+func (r Rendition) Bandwidth() int {
+	return int(float64(ParseBitRate(r.VideoBitRate)+ParseBitRate(r.AudioBitRate)) * 1.2)
+}
+
+// ParseBitRate converts ffmpeg style bitrates such as "500k" or "2.5M" to bits per second
+func ParseBitRate(bitRate string) int {
+	multiplier := 1.0
+	value := strings.TrimSpace(bitRate)
+	switch {
+	case strings.HasSuffix(value, "k"), strings.HasSuffix(value, "K"):
+		multiplier = 1000
+	case strings.HasSuffix(value, "M"), strings.HasSuffix(value, "m"):
+		multiplier = 1000 * 1000
+	}
+	value = strings.TrimRight(value, "kKmM")
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return int(n * multiplier)
+}
+
+var ladders = map[string][]Rendition{
+	LADDER_MOBILE: {
+		{
+			Name:         "180p",
+			Width:        320,
+			Height:       180,
+			VideoBitRate: "300k",
+			AudioBitRate: "64k",
+			Profile:      "baseline",
+		},
+		{
+			Name:         "360p",
+			Width:        640,
+			Height:       360,
+			VideoBitRate: "700k",
+			AudioBitRate: "96k",
+			Profile:      "main",
+		},
+	},
+	LADDER_STANDARD: {
+		{
+			Name:         "180p",
+			Width:        320,
+			Height:       180,
+			VideoBitRate: "500k",
+			AudioBitRate: "64k",
+		},
+		{
+			Name:         "480p",
+			Width:        854,
+			Height:       480,
+			VideoBitRate: "1000k",
+			AudioBitRate: "128k",
+		},
+		{
+			Name:         "720p",
+			Width:        1280,
+			Height:       720,
+			VideoBitRate: "2500k",
+			AudioBitRate: "192k",
+		},
+	},
+	// quality targeted, with the bitrate only capped for complex scenes
+	LADDER_PREMIUM_1080P: {
+		{
+			Name:         "360p",
+			Width:        640,
+			Height:       360,
+			VideoBitRate: "800k",
+			AudioBitRate: "96k",
+			MaxRate:      "1200k",
+			BufSize:      "1600k",
+			Profile:      "main",
+			RateControl:  RATE_CONTROL_CAPPED_CRF,
+		},
+		{
+			Name:         "480p",
+			Width:        854,
+			Height:       480,
+			VideoBitRate: "1400k",
+			AudioBitRate: "128k",
+			MaxRate:      "2100k",
+			BufSize:      "2800k",
+			Profile:      "main",
+			RateControl:  RATE_CONTROL_CAPPED_CRF,
+		},
+		{
+			Name:         "720p",
+			Width:        1280,
+			Height:       720,
+			VideoBitRate: "2800k",
+			AudioBitRate: "128k",
+			MaxRate:      "4200k",
+			BufSize:      "5600k",
+			Profile:      "high",
+			RateControl:  RATE_CONTROL_CAPPED_CRF,
+		},
+		{
+			Name:         "1080p",
+			Width:        1920,
+			Height:       1080,
+			VideoBitRate: "5000k",
+			AudioBitRate: "192k",
+			MaxRate:      "7500k",
+			BufSize:      "10000k",
+			Profile:      "high",
+			RateControl:  RATE_CONTROL_CAPPED_CRF,
+		},
+	},
+	// h264 renditions remain for devices that cannot decode hevc or av1
+	LADDER_MULTICODEC_1080P: {
+		{
+			Name:         "360p",
+			Width:        640,
+			Height:       360,
+			VideoBitRate: "800k",
+			AudioBitRate: "96k",
+			Profile:      "main",
+		},
+		{
+			Name:         "720p",
+			Width:        1280,
+			Height:       720,
+			VideoBitRate: "2800k",
+			AudioBitRate: "128k",
+			Profile:      "high",
+		},
+		{
+			Name:         "720phevc",
+			Width:        1280,
+			Height:       720,
+			VideoBitRate: "1800k",
+			AudioBitRate: "128k",
+			Profile:      "main",
+			Codec:        CODEC_HEVC,
+		},
+		{
+			Name:         "1080phevc",
+			Width:        1920,
+			Height:       1080,
+			VideoBitRate: "3200k",
+			AudioBitRate: "192k",
+			Profile:      "main",
+			Codec:        CODEC_HEVC,
+		},
+		{
+			Name:         "1080pav1",
+			Width:        1920,
+			Height:       1080,
+			VideoBitRate: "2500k",
+			AudioBitRate: "192k",
+			Codec:        CODEC_AV1,
+		},
+	},
+}
+
+var defaultLadder = LADDER_STANDARD
+
+var laddersLock sync.RWMutex
+
+type ladderConfig struct {
+	Default string                 `json:"default"`
+	Ladders map[string][]Rendition `json:"ladders"`
+}
+
+// LoadLadderConfig reads additional ladder presets from a json file of the form
+// {"default": "standard", "ladders": {"name": [rendition, ...]}}, where presets
+// with the same name as a built in one replace it
+func LoadLadderConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	config := ladderConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+
+	for name, renditions := range config.Ladders {
+		if err := ValidateLadder(renditions); err != nil {
+			return fmt.Errorf("invalid ladder %s: %w", name, err)
+		}
+	}
+
+	laddersLock.Lock()
+	defer laddersLock.Unlock()
+
+	for name, renditions := range config.Ladders {
+		ladders[name] = renditions
+	}
+
+	if config.Default != "" {
+		if _, ok := ladders[config.Default]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownLadder, config.Default)
+		}
+		defaultLadder = config.Default
+	}
+
+	return nil
+}
+
+// GetLadder returns the renditions of a preset, or of the default preset when name is empty
+func GetLadder(name string) ([]Rendition, error) {
+	laddersLock.RLock()
+	defer laddersLock.RUnlock()
+
+	if name == "" {
+		name = defaultLadder
+	}
+
+	renditions, ok := ladders[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownLadder, name)
+	}
+
+	return append([]Rendition{}, renditions...), nil
+}
+
+func ValidateLadder(renditions []Rendition) error {
+	if len(renditions) == 0 {
+		return fmt.Errorf("ladder has no renditions")
+	}
+
+	names := map[string]bool{}
+	for _, rendition := range renditions {
+		if err := utils.Validate(rendition); err != nil {
+			return err
+		}
+		if names[rendition.Name] {
+			return fmt.Errorf("duplicate rendition name %s", rendition.Name)
+		}
+		if ParseBitRate(rendition.VideoBitRate) <= 0 || ParseBitRate(rendition.AudioBitRate) <= 0 {
+			return fmt.Errorf("bitrates of rendition %s must be positive, e.g. 800k", rendition.Name)
+		}
+		if rendition.MaxRate != "" && ParseBitRate(rendition.MaxRate) <= 0 {
+			return fmt.Errorf("max rate of rendition %s must be positive, e.g. 1200k", rendition.Name)
+		}
+		codec := rendition.Codec
+		if codec == "" {
+			codec = CODEC_H264
+		}
+		if rendition.CRF > maxCRF[codec] {
+			return fmt.Errorf("crf of rendition %s must be at most %d for %s", rendition.Name, maxCRF[codec], codec)
+		}
+		names[rendition.Name] = true
+	}
+
+	return nil
+}
+
+// ResolveLadder picks the renditions for a request, where a custom ladder takes precedence over a named preset
+func ResolveLadder(profile string, custom []Rendition) ([]Rendition, error) {
+	if len(custom) > 0 {
+		if err := ValidateLadder(custom); err != nil {
+			return nil, err
+		}
+		return custom, nil
+	}
+	return GetLadder(profile)
+}
+
+// sourceVideoBitRate returns the bitrate of the first video stream, falling back to the
+// overall bitrate of the container for formats that do not report it per stream
+func sourceVideoBitRate(probe *ffprobe.ProbeData) int {
+	if stream := probe.GetFirstVideoStream(); stream != nil {
+		if bitRate, err := strconv.Atoi(stream.BitRate); err == nil && bitRate > 0 {
+			return bitRate
+		}
+	}
+	if probe.Format != nil {
+		if bitRate, err := strconv.Atoi(probe.Format.BitRate); err == nil {
+			return bitRate
+		}
+	}
+	return 0
+}
+
+// PruneLadder drops renditions that would upscale the source or exceed its bitrate, always keeping
+// at least the lowest rung. The rendition height is compared against the short side of the source so
+// that portrait videos are not pruned away. Of the renditions above the source bitrate only the one
+// targeting the least is kept, at the source bitrate, so that a source whose bitrate falls between two
+// rungs still gets its full quality without several renditions being encoded at the same bitrate
+func PruneLadder(renditions []Rendition, source SourceGeometry, sourceBitRate int) []Rendition {
+	if len(renditions) == 0 {
+		return renditions
+	}
+
+	fitting := []Rendition{}
+	lowest := renditions[0]
+	for _, rendition := range renditions {
+		if rendition.Height < lowest.Height {
+			lowest = rendition
+		}
+		if rendition.Height <= source.shortSide() {
+			fitting = append(fitting, rendition)
+		}
+	}
+
+	if len(fitting) == 0 {
+		return []Rendition{clampBitRate(lowest, sourceBitRate)}
+	}
+	if sourceBitRate <= 0 {
+		return fitting
+	}
+
+	// the rendition above the source bitrate that is closest to it
+	ceiling := -1
+	for i, rendition := range fitting {
+		bitRate := ParseBitRate(rendition.VideoBitRate)
+		if bitRate > sourceBitRate && (ceiling == -1 || bitRate < ParseBitRate(fitting[ceiling].VideoBitRate)) {
+			ceiling = i
+		}
+	}
+
+	pruned := []Rendition{}
+	for i, rendition := range fitting {
+		if i != ceiling && ParseBitRate(rendition.VideoBitRate) > sourceBitRate {
+			continue
+		}
+		pruned = append(pruned, clampBitRate(rendition, sourceBitRate))
+	}
+
+	return pruned
+}
+
+// clampBitRate lowers the target and max rate of a rendition to the source bitrate, when it is known
+func clampBitRate(rendition Rendition, sourceBitRate int) Rendition {
+	if sourceBitRate <= 0 {
+		return rendition
+	}
+	if ParseBitRate(rendition.VideoBitRate) > sourceBitRate {
+		rendition.VideoBitRate = formatBitRate(sourceBitRate)
+	}
+	if ParseBitRate(rendition.maxRate()) > sourceBitRate {
+		rendition.MaxRate = formatBitRate(sourceBitRate)
+	}
+	return rendition
+}
+
+// ResolveAudioLadder picks the audio renditions for a request. A custom audio ladder takes precedence,
+// otherwise a single audio rendition at the highest audio bitrate of the ladder is used when separate is set.
+// An empty result means audio is muxed into every video rendition
+func ResolveAudioLadder(separate bool, custom []AudioRendition, ladder []Rendition) ([]AudioRendition, error) {
+	if len(custom) == 0 {
+		if !separate || len(ladder) == 0 {
+			return nil, nil
+		}
+
+		highest := ladder[0]
+		for _, rendition := range ladder {
+			if ParseBitRate(rendition.AudioBitRate) > ParseBitRate(highest.AudioBitRate) {
+				highest = rendition
+			}
+		}
+
+		return []AudioRendition{
+			{
+				Name:    "audio",
+				BitRate: highest.AudioBitRate,
+			},
+		}, nil
+	}
+
+	// audio renditions share the output directory with the video renditions
+	names := map[string]bool{}
+	for _, rendition := range ladder {
+		names[rendition.Name] = true
+	}
+
+	for _, audio := range custom {
+		if err := utils.Validate(audio); err != nil {
+			return nil, err
+		}
+		if names[audio.Name] {
+			return nil, fmt.Errorf("duplicate rendition name %s", audio.Name)
+		}
+		names[audio.Name] = true
+	}
+
+	return custom, nil
+}
@@ -0,0 +1,183 @@
+package mediautils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBitRate(t *testing.T) {
+	tests := []struct {
+		bitRate string
+		want    int
+	}{
+		{bitRate: "500k", want: 500000},
+		{bitRate: "500K", want: 500000},
+		{bitRate: "2.5M", want: 2500000},
+		{bitRate: "3m", want: 3000000},
+		{bitRate: " 800k ", want: 800000},
+		{bitRate: "128000", want: 128000},
+		{bitRate: "", want: 0},
+		{bitRate: "fast", want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := ParseBitRate(tt.bitRate); got != tt.want {
+			t.Errorf("ParseBitRate(%q) = %d, want %d", tt.bitRate, got, tt.want)
+		}
+	}
+}
+
+func TestPruneLadder(t *testing.T) {
+	ladder := []Rendition{
+		{Name: "360p", Width: 640, Height: 360, VideoBitRate: "800k"},
+		{Name: "720p", Width: 1280, Height: 720, VideoBitRate: "2800k"},
+		{Name: "1080p", Width: 1920, Height: 1080, VideoBitRate: "5000k", MaxRate: "7500k"},
+	}
+
+	tests := []struct {
+		name          string
+		source        SourceGeometry
+		sourceBitRate int
+		want          []Rendition
+	}{
+		{
+			name:   "keeps every rung of a large source",
+			source: SourceGeometry{Width: 3840, Height: 2160},
+			want:   ladder,
+		},
+		{
+			name:   "drops rungs that would upscale",
+			source: SourceGeometry{Width: 1280, Height: 720},
+			want:   ladder[:2],
+		},
+		{
+			name:   "compares portrait sources on their short side",
+			source: SourceGeometry{Width: 720, Height: 1280},
+			want:   ladder[:2],
+		},
+		{
+			name:   "keeps the lowest rung of a tiny source",
+			source: SourceGeometry{Width: 320, Height: 180},
+			want:   ladder[:1],
+		},
+		{
+			name:          "clamps rungs above the source bitrate",
+			source:        SourceGeometry{Width: 1920, Height: 1080},
+			sourceBitRate: 4000000,
+			want: []Rendition{
+				ladder[0],
+				{Name: "720p", Width: 1280, Height: 720, VideoBitRate: "2800k", MaxRate: "4000k"},
+				{Name: "1080p", Width: 1920, Height: 1080, VideoBitRate: "4000k", MaxRate: "4000k"},
+			},
+		},
+		{
+			name:          "keeps a single rung above a low source bitrate",
+			source:        SourceGeometry{Width: 1920, Height: 1080},
+			sourceBitRate: 1500000,
+			want: []Rendition{
+				ladder[0],
+				{Name: "720p", Width: 1280, Height: 720, VideoBitRate: "1500k", MaxRate: "1500k"},
+			},
+		},
+		{
+			name:          "keeps the lowest rung of a source below every bitrate",
+			source:        SourceGeometry{Width: 1920, Height: 1080},
+			sourceBitRate: 600000,
+			want: []Rendition{
+				{Name: "360p", Width: 640, Height: 360, VideoBitRate: "600k", MaxRate: "600k"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PruneLadder(ladder, tt.source, tt.sourceBitRate)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d renditions %v, want %v", len(got), got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("rendition %d is %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateLadder(t *testing.T) {
+	rendition := Rendition{Name: "720p", Width: 1280, Height: 720, VideoBitRate: "2800k", AudioBitRate: "128k"}
+	with := func(change func(*Rendition)) []Rendition {
+		r := rendition
+		change(&r)
+		return []Rendition{r}
+	}
+
+	tests := []struct {
+		name    string
+		ladder  []Rendition
+		wantErr bool
+	}{
+		{name: "valid", ladder: []Rendition{rendition}},
+		{name: "empty", ladder: nil, wantErr: true},
+		{name: "duplicate name", ladder: []Rendition{rendition, rendition}, wantErr: true},
+		{name: "unparsable video bitrate", ladder: with(func(r *Rendition) { r.VideoBitRate = "fast" }), wantErr: true},
+		{name: "zero audio bitrate", ladder: with(func(r *Rendition) { r.AudioBitRate = "0k" }), wantErr: true},
+		{name: "unparsable max rate", ladder: with(func(r *Rendition) { r.MaxRate = "high" }), wantErr: true},
+		{name: "max rate", ladder: with(func(r *Rendition) { r.MaxRate = "4200k" })},
+		{name: "h264 crf in range", ladder: with(func(r *Rendition) { r.CRF = 51 })},
+		{name: "h264 crf out of range", ladder: with(func(r *Rendition) { r.CRF = 52 }), wantErr: true},
+		{name: "hevc crf out of range", ladder: with(func(r *Rendition) { r.Codec = CODEC_HEVC; r.CRF = 60 }), wantErr: true},
+		{name: "av1 crf in range", ladder: with(func(r *Rendition) { r.Codec = CODEC_AV1; r.CRF = 63 })},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateLadder(tt.ladder); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveAudioLadder(t *testing.T) {
+	ladder := []Rendition{
+		{Name: "360p", Width: 640, Height: 360, VideoBitRate: "800k", AudioBitRate: "96k"},
+		{Name: "720p", Width: 1280, Height: 720, VideoBitRate: "2800k", AudioBitRate: "128k"},
+		{Name: "1080p", Width: 1920, Height: 1080, VideoBitRate: "5000k", AudioBitRate: "128k"},
+	}
+
+	tests := []struct {
+		name     string
+		separate bool
+		custom   []AudioRendition
+		want     []AudioRendition
+		wantErr  bool
+	}{
+		{name: "muxed", separate: false, want: nil},
+		{name: "separate at the highest audio bitrate", separate: true, want: []AudioRendition{{Name: "audio", BitRate: "128k"}}},
+		{
+			name:   "custom takes precedence",
+			custom: []AudioRendition{{Name: "low", BitRate: "64k"}, {Name: "high", BitRate: "192k"}},
+			want:   []AudioRendition{{Name: "low", BitRate: "64k"}, {Name: "high", BitRate: "192k"}},
+		},
+		{name: "custom clashes with a video rendition", custom: []AudioRendition{{Name: "720p", BitRate: "128k"}}, wantErr: true},
+		{name: "duplicate custom name", custom: []AudioRendition{{Name: "aac", BitRate: "64k"}, {Name: "aac", BitRate: "128k"}}, wantErr: true},
+		{name: "custom without a bitrate", custom: []AudioRendition{{Name: "aac"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveAudioLadder(tt.separate, tt.custom, ladder)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if got, err := ResolveAudioLadder(true, nil, nil); err != nil || got != nil {
+		t.Fatalf("got %+v, %v for an empty ladder, want nil", got, err)
+	}
+}
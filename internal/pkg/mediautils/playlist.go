@@ -0,0 +1,411 @@
+package mediautils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	ffprobe "github.com/vansante/go-ffprobe"
+)
+
+// PlaylistInfo describes an encoded media playlist as advertised in the master playlist
+type PlaylistInfo struct {
+	// peak segment bitrate in bits per second
+	PeakBandwidth int
+	// bitrate over the whole playlist in bits per second
+	AverageBandwidth int
+	// RFC 6381 codec strings of the encoded streams, e.g. avc1.64001f,mp4a.40.2
+	Codecs string
+	// codec string of the video stream alone, as advertised for I-frame playlists
+	VideoCodec string
+	FrameRate  float64
+}
+
+type mediaSegment struct {
+	Uri      string
+	Duration float64
+}
+
+type mediaPlaylist struct {
+	// uri of the EXT-X-MAP init segment of fmp4 playlists
+	InitUri  string
+	Segments []mediaSegment
+}
+
+var uriAttributeRegexp = regexp.MustCompile(`URI="([^"]*)"`)
+
+// rewritePlaylistUris maps every uri of a playlist, i.e. segment and playlist lines as well as
+// the URI attributes of tags such as EXT-X-MAP and EXT-X-MEDIA
+func rewritePlaylistUris(content string, rewrite func(uri string) string) string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#"):
+			lines[i] = uriAttributeRegexp.ReplaceAllStringFunc(line, func(attribute string) string {
+				uri := uriAttributeRegexp.FindStringSubmatch(attribute)[1]
+				return fmt.Sprintf("URI=\"%s\"", rewrite(uri))
+			})
+		default:
+			lines[i] = rewrite(trimmed)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseMediaPlaylist reads the segments of a media playlist along with their EXTINF durations
+func parseMediaPlaylist(playlistFileName string) (*mediaPlaylist, error) {
+	f, err := os.Open(playlistFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	playlist := mediaPlaylist{}
+	segments := []mediaSegment{}
+	duration := -1.0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			if match := uriAttributeRegexp.FindStringSubmatch(line); match != nil {
+				playlist.InitUri = match[1]
+			}
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			duration, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXTINF in %s: %w", playlistFileName, err)
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			if duration >= 0 {
+				segments = append(segments, mediaSegment{
+					Uri:      line,
+					Duration: duration,
+				})
+			}
+			duration = -1
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	playlist.Segments = segments
+
+	return &playlist, nil
+}
+
+// segmentFileName resolves a segment uri against the directory of its playlist
+func segmentFileName(playlistFileName, uri string) string {
+	return filepath.Join(filepath.Dir(playlistFileName), filepath.Base(uri))
+}
+
+// measureBandwidth computes the peak and average bitrate of a playlist from the size of its segments
+func measureBandwidth(playlistFileName string, segments []mediaSegment) (int, int, error) {
+	var peak float64
+	var totalBits float64
+	var totalDuration float64
+
+	for _, segment := range segments {
+		info, err := os.Stat(segmentFileName(playlistFileName, segment.Uri))
+		if err != nil {
+			return 0, 0, err
+		}
+
+		bits := float64(info.Size() * 8)
+		totalBits += bits
+		totalDuration += segment.Duration
+
+		if segment.Duration > 0 {
+			peak = math.Max(peak, bits/segment.Duration)
+		}
+	}
+
+	if totalDuration == 0 {
+		return 0, 0, fmt.Errorf("playlist %s has no segments", playlistFileName)
+	}
+
+	return int(math.Ceil(peak)), int(math.Ceil(totalBits / totalDuration)), nil
+}
+
+// h264 profile_idc and constraint flags as used in avc1 codec strings
+var avcProfiles = map[string]string{
+	"Constrained Baseline":  "42e0",
+	"Baseline":              "4200",
+	"Main":                  "4d40",
+	"Extended":              "5800",
+	"High":                  "6400",
+	"High 10":               "6e00",
+	"High 4:2:2":            "7a00",
+	"High 4:4:4 Predictive": "f400",
+}
+
+// hevc general_profile_idc and profile compatibility flags as used in hvc1 codec strings
+var hevcProfiles = map[string]string{
+	"Main":    "1.6",
+	"Main 10": "2.4",
+	"Rext":    "4.10",
+}
+
+var av1Profiles = map[string]int{
+	"Main":         0,
+	"High":         1,
+	"Professional": 2,
+}
+
+// bitDepth reads the bit depth of a stream from its pixel format, e.g. yuv420p10le
+func bitDepth(stream *ffprobe.Stream) int {
+	for _, depth := range []int{10, 12} {
+		if strings.Contains(stream.PixFmt, fmt.Sprintf("p%d", depth)) {
+			return depth
+		}
+	}
+	return 8
+}
+
+func videoCodecString(stream *ffprobe.Stream) (string, error) {
+	switch stream.CodecName {
+	case "h264":
+		profile, ok := avcProfiles[stream.Profile]
+		if !ok {
+			return "", fmt.Errorf("unknown h264 profile %s", stream.Profile)
+		}
+		return fmt.Sprintf("avc1.%s%02x", profile, stream.Level), nil
+	case "hevc":
+		profile, ok := hevcProfiles[stream.Profile]
+		if !ok {
+			return "", fmt.Errorf("unknown hevc profile %s", stream.Profile)
+		}
+		// ffprobe reports general_level_idc, the main tier is assumed as it does not report the tier.
+		// B0 is the progressive source constraint flag that x265 sets
+		return fmt.Sprintf("hvc1.%s.L%d.B0", profile, stream.Level), nil
+	case "av1":
+		profile, ok := av1Profiles[stream.Profile]
+		if !ok {
+			return "", fmt.Errorf("unknown av1 profile %s", stream.Profile)
+		}
+		// ffprobe reports seq_level_idx, again in the main tier
+		return fmt.Sprintf("av01.%d.%02dM.%02d", profile, stream.Level, bitDepth(stream)), nil
+	}
+	return "", fmt.Errorf("unsupported video codec %s", stream.CodecName)
+}
+
+func audioCodecString(stream *ffprobe.Stream) (string, error) {
+	switch stream.CodecName {
+	case "aac":
+		switch stream.Profile {
+		case "HE-AAC":
+			return "mp4a.40.5", nil
+		case "HE-AACv2":
+			return "mp4a.40.29", nil
+		}
+		return "mp4a.40.2", nil
+	case "mp3":
+		return "mp4a.40.34", nil
+	case "ac3":
+		return "ac-3", nil
+	case "eac3":
+		return "ec-3", nil
+	}
+	return "", fmt.Errorf("unsupported audio codec %s", stream.CodecName)
+}
+
+// joinInitSegment writes the init segment followed by a media segment into a temporary mp4 file
+func joinInitSegment(playlistFileName, initUri, segmentUri string) (string, error) {
+	f, err := os.CreateTemp("", "*.mp4")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, uri := range []string{initUri, segmentUri} {
+		data, err := os.ReadFile(segmentFileName(playlistFileName, uri))
+		if err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+		if _, err := f.Write(data); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+
+	return f.Name(), nil
+}
+
+// parseFrameRate parses ffprobe frame rates such as "30000/1001"
+func parseFrameRate(frameRate string) float64 {
+	num, den, found := strings.Cut(frameRate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// describePlaylist measures the bitrates of an encoded playlist and probes its first segment for codecs and frame rate
+func describePlaylist(ctx context.Context, playlistFileName string) (*PlaylistInfo, error) {
+	playlist, err := parseMediaPlaylist(playlistFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	peak, average, err := measureBandwidth(playlistFileName, playlist.Segments)
+	if err != nil {
+		return nil, err
+	}
+
+	probeFileName := segmentFileName(playlistFileName, playlist.Segments[0].Uri)
+	if playlist.InitUri != "" {
+		// fmp4 media segments cannot be probed without their init segment
+		probeFileName, err = joinInitSegment(playlistFileName, playlist.InitUri, playlist.Segments[0].Uri)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(probeFileName)
+	}
+
+	data, err := ffprobe.GetProbeDataContext(ctx, probeFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &PlaylistInfo{
+		PeakBandwidth:    peak,
+		AverageBandwidth: average,
+	}
+
+	codecs := []string{}
+	if stream := data.GetFirstVideoStream(); stream != nil {
+		codec, err := videoCodecString(stream)
+		if err != nil {
+			return nil, err
+		}
+		codecs = append(codecs, codec)
+		info.VideoCodec = codec
+		info.FrameRate = parseFrameRate(stream.AvgFrameRate)
+		if info.FrameRate == 0 {
+			info.FrameRate = parseFrameRate(stream.RFrameRate)
+		}
+	}
+	if stream := data.GetFirstAudioStream(); stream != nil {
+		codec, err := audioCodecString(stream)
+		if err != nil {
+			return nil, err
+		}
+		codecs = append(codecs, codec)
+	}
+	info.Codecs = strings.Join(codecs, ",")
+
+	return info, nil
+}
+
+// selectAudioPlaylist picks the audio rendition with the highest bitrate that does not exceed
+// the audio bitrate of the video rendition, or the lowest one if they all do. Only the default
+// track is considered, as the other tracks of a group are encoded at the same bitrate
+func selectAudioPlaylist(rendition Rendition, audioPlaylists []AudioPlaylist) *AudioPlaylist {
+	var selected *AudioPlaylist
+	target := ParseBitRate(rendition.AudioBitRate)
+
+	for i := range audioPlaylists {
+		candidate := &audioPlaylists[i]
+		if !candidate.Track.Default {
+			continue
+		}
+		bitRate := ParseBitRate(candidate.Rendition.BitRate)
+		switch {
+		case selected == nil:
+			selected = candidate
+		case bitRate <= target && (ParseBitRate(selected.Rendition.BitRate) > target || bitRate > ParseBitRate(selected.Rendition.BitRate)):
+			selected = candidate
+		case bitRate > target && bitRate < ParseBitRate(selected.Rendition.BitRate):
+			selected = candidate
+		}
+	}
+
+	return selected
+}
+
+// audioMedia formats the EXT-X-MEDIA tag of an audio rendition without its URI
+func audioMedia(audioPlaylist AudioPlaylist) string {
+	track := audioPlaylist.Track
+	attributes := []string{
+		"TYPE=AUDIO",
+		fmt.Sprintf("GROUP-ID=\"%s\"", audioPlaylist.Rendition.GroupId()),
+		fmt.Sprintf("NAME=\"%s\"", strings.ReplaceAll(track.Name(), "\"", "'")),
+	}
+
+	if track.Language != "" && track.Language != "und" {
+		attributes = append(attributes, fmt.Sprintf("LANGUAGE=\"%s\"", track.Language))
+	}
+
+	if track.Default {
+		attributes = append(attributes, "DEFAULT=YES")
+	} else {
+		attributes = append(attributes, "DEFAULT=NO")
+	}
+
+	return "#EXT-X-MEDIA:" + strings.Join(append(attributes, "AUTOSELECT=YES"), ",")
+}
+
+// streamInf formats the EXT-X-STREAM-INF attributes of a playlist, falling back to
+// the bitrate estimate of the rendition when the encoded output could not be measured.
+// The bitrates and codecs of the audio group, if any, are included as the variant plays both
+func streamInf(playlist Playlist, audio *AudioPlaylist) string {
+	attributes := []string{}
+
+	if playlist.Info != nil && (audio == nil || audio.Info != nil) {
+		peak := playlist.Info.PeakBandwidth
+		average := playlist.Info.AverageBandwidth
+		if audio != nil {
+			peak += audio.Info.PeakBandwidth
+			average += audio.Info.AverageBandwidth
+		}
+		attributes = append(attributes,
+			fmt.Sprintf("BANDWIDTH=%d", peak),
+			fmt.Sprintf("AVERAGE-BANDWIDTH=%d", average),
+		)
+	} else {
+		attributes = append(attributes, fmt.Sprintf("BANDWIDTH=%d", playlist.Rendition.Bandwidth()))
+	}
+
+	attributes = append(attributes, "RESOLUTION="+playlist.Rendition.Resolution())
+
+	if playlist.Info != nil {
+		codecs := playlist.Info.Codecs
+		if audio != nil && audio.Info != nil && audio.Info.Codecs != "" {
+			codecs += "," + audio.Info.Codecs
+		}
+		if codecs != "" {
+			attributes = append(attributes, fmt.Sprintf("CODECS=\"%s\"", codecs))
+		}
+		if playlist.Info.FrameRate > 0 {
+			attributes = append(attributes, fmt.Sprintf("FRAME-RATE=%.3f", playlist.Info.FrameRate))
+		}
+	}
+
+	if audio != nil {
+		attributes = append(attributes, fmt.Sprintf("AUDIO=\"%s\"", audio.Rendition.GroupId()))
+	}
+
+	return "#EXT-X-STREAM-INF:" + strings.Join(attributes, ",")
+}
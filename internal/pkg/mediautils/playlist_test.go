@@ -0,0 +1,210 @@
+package mediautils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	ffprobe "github.com/vansante/go-ffprobe"
+)
+
+func TestVideoCodecString(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  *ffprobe.Stream
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "h264 high",
+			stream: &ffprobe.Stream{CodecName: "h264", Profile: "High", Level: 40},
+			want:   "avc1.640028",
+		},
+		{
+			name:   "h264 constrained baseline",
+			stream: &ffprobe.Stream{CodecName: "h264", Profile: "Constrained Baseline", Level: 30},
+			want:   "avc1.42e01e",
+		},
+		{
+			name:   "hevc main",
+			stream: &ffprobe.Stream{CodecName: "hevc", Profile: "Main", Level: 120},
+			want:   "hvc1.1.6.L120.B0",
+		},
+		{
+			name:   "av1 main 10 bit",
+			stream: &ffprobe.Stream{CodecName: "av1", Profile: "Main", Level: 8, PixFmt: "yuv420p10le"},
+			want:   "av01.0.08M.10",
+		},
+		{
+			name:   "av1 main 8 bit",
+			stream: &ffprobe.Stream{CodecName: "av1", Profile: "Main", Level: 12, PixFmt: "yuv420p"},
+			want:   "av01.0.12M.08",
+		},
+		{
+			name:    "unknown h264 profile",
+			stream:  &ffprobe.Stream{CodecName: "h264", Profile: "Unknown", Level: 40},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported codec",
+			stream:  &ffprobe.Stream{CodecName: "vp9", Profile: "Profile 0"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := videoCodecString(tt.stream)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeasureBandwidth(t *testing.T) {
+	dir := t.TempDir()
+	playlistFileName := filepath.Join(dir, "720p.m3u8")
+	for fileName, size := range map[string]int{"720p_000.ts": 1000, "720p_001.ts": 3000} {
+		if err := os.WriteFile(filepath.Join(dir, fileName), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peak, average, err := measureBandwidth(playlistFileName, []mediaSegment{
+		{Uri: "720p_000.ts", Duration: 2},
+		{Uri: "720p_001.ts", Duration: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peak != 12000 || average != 8000 {
+		t.Fatalf("got peak %d and average %d, want 12000 and 8000", peak, average)
+	}
+
+	if _, _, err := measureBandwidth(playlistFileName, nil); err == nil {
+		t.Fatal("expected an error for a playlist without segments")
+	}
+}
+
+func TestParseMediaPlaylist(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *mediaPlaylist
+		wantErr bool
+	}{
+		{
+			name: "mpeg-ts",
+			content: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXTINF:4.000000,
+720p_000.ts
+#EXTINF:3.5,
+720p_001.ts
+#EXT-X-ENDLIST
+`,
+			want: &mediaPlaylist{
+				Segments: []mediaSegment{
+					{Uri: "720p_000.ts", Duration: 4},
+					{Uri: "720p_001.ts", Duration: 3.5},
+				},
+			},
+		},
+		{
+			name: "fmp4 with byte ranges and titles",
+			content: `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-MAP:URI="720p_init.mp4"
+#EXTINF:2.002,first
+#EXT-X-BYTERANGE:1000@0
+720p.m4s
+
+#EXTINF:1.001,
+#EXT-X-BYTERANGE:800@1000
+720p.m4s
+#EXT-X-ENDLIST
+`,
+			want: &mediaPlaylist{
+				InitUri: "720p_init.mp4",
+				Segments: []mediaSegment{
+					{Uri: "720p.m4s", Duration: 2.002},
+					{Uri: "720p.m4s", Duration: 1.001},
+				},
+			},
+		},
+		{
+			name:    "uris without EXTINF are ignored",
+			content: "#EXTM3U\n720p.m3u8\n",
+			want:    &mediaPlaylist{Segments: []mediaSegment{}},
+		},
+		{
+			name:    "invalid duration",
+			content: "#EXTM3U\n#EXTINF:abc,\n720p_000.ts\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			playlistFileName := filepath.Join(t.TempDir(), "720p.m3u8")
+			if err := os.WriteFile(playlistFileName, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseMediaPlaylist(playlistFileName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewritePlaylistUris(t *testing.T) {
+	prefix := func(uri string) string {
+		return "https://cdn.example.com/video/" + uri
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "segments",
+			content: "#EXTM3U\n#EXTINF:4.000000,\n720p_000.ts\n#EXT-X-ENDLIST\n",
+			want:    "#EXTM3U\n#EXTINF:4.000000,\nhttps://cdn.example.com/video/720p_000.ts\n#EXT-X-ENDLIST\n",
+		},
+		{
+			name:    "init segment",
+			content: "#EXT-X-MAP:URI=\"720p_init.mp4\"\n",
+			want:    "#EXT-X-MAP:URI=\"https://cdn.example.com/video/720p_init.mp4\"\n",
+		},
+		{
+			name:    "audio rendition and variant",
+			content: "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio-128k\",URI=\"audio_128k.m3u8\"\n#EXT-X-STREAM-INF:BANDWIDTH=1000\n  720p.m3u8  \n",
+			want:    "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio-128k\",URI=\"https://cdn.example.com/video/audio_128k.m3u8\"\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nhttps://cdn.example.com/video/720p.m3u8\n",
+		},
+		{
+			name:    "tags without uris",
+			content: "#EXTM3U\n#EXT-X-VERSION:7\n\n",
+			want:    "#EXTM3U\n#EXT-X-VERSION:7\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewritePlaylistUris(tt.content, prefix); got != tt.want {
+				t.Fatalf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package mediautils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// number of frames sampled over the source to choose the poster from
+const posterCandidateCount = 10
+
+// average luma outside of which a frame is considered black or blown out
+const minPosterLuma = 32
+const maxPosterLuma = 224
+
+// widths the poster is generated at, never larger than the source
+var posterWidths = []int{1280, 640, 320}
+
+var posterFormats = []string{IMAGE_FORMAT_JPEG, IMAGE_FORMAT_WEBP}
+
+// PosterImage is the poster of a video at one size and format
+type PosterImage struct {
+	Url    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	// path in the output directory, before it is uploaded
+	fileName string
+}
+
+type posterCandidate struct {
+	fileName string
+	offset   float64
+	luma     float64
+	entropy  float64
+	blur     float64
+}
+
+// usable is false for frames that are mostly black or white, such as fades and title cards
+func (c posterCandidate) usable() bool {
+	return c.luma >= minPosterLuma && c.luma <= maxPosterLuma
+}
+
+// score favours detailed frames, which have a high entropy, over blurry ones
+func (c posterCandidate) score() float64 {
+	return c.entropy / (1 + c.blur)
+}
+
+// parseFrameMetadata reads the key=value lines printed by the metadata filter
+func parseFrameMetadata(out []byte) map[string]float64 {
+	metadata := map[string]float64{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			metadata[key] = n
+		}
+	}
+	return metadata
+}
+
+// captureCandidate saves the frame at offset and measures its brightness, detail and blur
+func captureCandidate(ctx context.Context, videoFileName string, offset float64, blurDetect bool) (*posterCandidate, error) {
+	candidate := posterCandidate{
+		fileName: filepath.Join(os.TempDir(), "poster-"+uuid.NewString()+".png"),
+		offset:   offset,
+	}
+
+	filters := "signalstats,entropy"
+	if blurDetect {
+		filters += ",blurdetect"
+	}
+	filters += ",metadata=print:file=-"
+
+	out, err := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner",
+		"-loglevel", "error",
+		"-ss", fmt.Sprintf("%.3f", offset),
+		"-i", videoFileName,
+		"-frames:v", "1",
+		"-vf", filters,
+		"-y", candidate.fileName,
+	).Output()
+	if err != nil {
+		os.Remove(candidate.fileName)
+		return nil, err
+	}
+
+	metadata := parseFrameMetadata(out)
+	candidate.luma = metadata["lavfi.signalstats.YAVG"]
+	candidate.entropy = metadata["lavfi.entropy.normalized_entropy.normal.Y"]
+	candidate.blur = metadata["lavfi.blur"]
+
+	return &candidate, nil
+}
+
+// choosePosterFrame samples frames evenly over the source and returns the most detailed one
+// that is not black or blown out, or the most detailed one when every frame is
+func choosePosterFrame(ctx context.Context, videoFileName string, duration float64) (*posterCandidate, error) {
+	available, err := availableFilters()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []posterCandidate{}
+	defer func() {
+		for _, candidate := range candidates {
+			os.Remove(candidate.fileName)
+		}
+	}()
+
+	for i := 1; i <= posterCandidateCount; i++ {
+		candidate, err := captureCandidate(ctx, videoFileName, duration*float64(i)/(posterCandidateCount+1), available["blurdetect"])
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, *candidate)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].usable() != candidates[j].usable() {
+			return candidates[i].usable()
+		}
+		return candidates[i].score() > candidates[j].score()
+	})
+
+	// the chosen frame is kept until the poster is generated from it
+	best := candidates[0]
+	candidates = candidates[1:]
+
+	return &best, nil
+}
+
+// GeneratePoster picks the best frame of the source and writes it into outputDir at every poster size and format
+func GeneratePoster(ctx context.Context, videoFileName, outputDir, outputPrefix string, source SourceGeometry, duration float64) ([]PosterImage, error) {
+	if duration <= 0 {
+		return nil, fmt.Errorf("unknown duration of source")
+	}
+
+	frame, err := choosePosterFrame(ctx, videoFileName, duration)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(frame.fileName)
+
+	images := []PosterImage{}
+	for _, width := range posterWidths {
+		// the smallest size is always generated so that small sources still get a poster
+		if width > source.Width && width != posterWidths[len(posterWidths)-1] {
+			continue
+		}
+		width = min(width, evenDimension(float64(source.Width)))
+		height := evenDimension(float64(width) * float64(source.Height) / float64(source.Width))
+
+		for _, format := range posterFormats {
+			image := PosterImage{
+				Width:    width,
+				Height:   height,
+				Format:   format,
+				fileName: fmt.Sprintf("%s/%s_poster_%d.%s", outputDir, outputPrefix, width, format),
+			}
+
+			kwArgs := ffmpeg.KwArgs{
+				"vf":       fmt.Sprintf("scale=%d:%d,setsar=1", width, height),
+				"frames:v": "1",
+			}
+			if format == IMAGE_FORMAT_JPEG {
+				kwArgs["q:v"] = "2"
+			} else {
+				kwArgs["compression_level"] = "6"
+			}
+
+			if err := runFFmpeg(ctx, ffmpeg.Input(frame.fileName).Output(image.fileName, kwArgs)); err != nil {
+				return nil, err
+			}
+
+			images = append(images, image)
+		}
+	}
+
+	return images, nil
+}
+
+// generatePoster generates the poster of a transcode in its output directory, when it was requested
+func generatePoster(ctx context.Context, videoFileName, outputDir, outputPrefix string, opts *TranscodeOptions) ([]PosterImage, error) {
+	if !opts.Poster || opts.Probe == nil {
+		return nil, nil
+	}
+
+	source, ok := NewSourceGeometry(opts.Probe, probeRotation(ctx, videoFileName))
+	if !ok {
+		return nil, fmt.Errorf("source has no video stream to capture a poster from")
+	}
+
+	if opts.OnPosterStart != nil {
+		opts.OnPosterStart()
+	}
+
+	return GeneratePoster(ctx, videoFileName, outputDir, outputPrefix, source, opts.sourceDuration())
+}
@@ -0,0 +1,71 @@
+package mediautils
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// progressWriter parses the key=value blocks that ffmpeg writes when run with
+// "-progress pipe:1" and reports how far the encode is relative to duration
+type progressWriter struct {
+	duration   float64
+	onProgress func(percent float64)
+	buf        []byte
+	outTime    float64
+}
+
+func newProgressWriter(duration float64, onProgress func(percent float64)) *progressWriter {
+	return &progressWriter{
+		duration:   duration,
+		onProgress: onProgress,
+	}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.handleLine(strings.TrimSpace(string(w.buf[:i])))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (w *progressWriter) handleLine(line string) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return
+	}
+
+	switch key {
+	// out_time_ms is misnamed by ffmpeg and is also in microseconds
+	case "out_time_us", "out_time_ms":
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+			w.outTime = float64(us) / 1e6
+		}
+	case "progress":
+		if value == "end" {
+			w.report(100)
+			return
+		}
+		if w.duration > 0 {
+			w.report(w.outTime / w.duration * 100)
+		}
+	}
+}
+
+func (w *progressWriter) report(percent float64) {
+	if percent > 100 {
+		percent = 100
+	}
+	if percent < 0 {
+		percent = 0
+	}
+	w.onProgress(percent)
+}
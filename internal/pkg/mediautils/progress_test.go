@@ -0,0 +1,86 @@
+package mediautils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProgressWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration float64
+		writes   []string
+		want     []float64
+	}{
+		{
+			name:     "reports on every progress block",
+			duration: 10,
+			writes: []string{
+				"frame=50\nout_time_us=2500000\nprogress=continue\n",
+				"out_time_us=5000000\nprogress=continue\n",
+			},
+			want: []float64{25, 50},
+		},
+		{
+			name:     "lines split across writes",
+			duration: 10,
+			writes:   []string{"out_time_us=75", "00000\nprog", "ress=continue\n"},
+			want:     []float64{75},
+		},
+		{
+			name:     "out_time_ms is in microseconds too",
+			duration: 4,
+			writes:   []string{"out_time_ms=1000000\r\nprogress=continue\r\n"},
+			want:     []float64{25},
+		},
+		{
+			name:     "clamped past the duration",
+			duration: 10,
+			writes:   []string{"out_time_us=12000000\nprogress=continue\n"},
+			want:     []float64{100},
+		},
+		{
+			name:     "negative times at the start of the encode",
+			duration: 10,
+			writes:   []string{"out_time_us=-40000\nprogress=continue\n"},
+			want:     []float64{0},
+		},
+		{
+			name:     "end completes without a duration",
+			duration: 0,
+			writes:   []string{"out_time_us=5000000\nprogress=continue\nprogress=end\n"},
+			want:     []float64{100},
+		},
+		{
+			name:     "malformed lines are ignored",
+			duration: 10,
+			writes:   []string{"out_time_us=N/A\ngarbage\nout_time_us=1000000\nprogress=continue\n"},
+			want:     []float64{10},
+		},
+		{
+			name:     "incomplete line is held back",
+			duration: 10,
+			writes:   []string{"out_time_us=1000000\nprogress=continue"},
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []float64
+			w := newProgressWriter(tt.duration, func(percent float64) {
+				got = append(got, percent)
+			})
+
+			for _, write := range tt.writes {
+				if n, err := w.Write([]byte(write)); err != nil || n != len(write) {
+					t.Fatalf("Write(%q) = %d, %v, want %d, nil", write, n, err, len(write))
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package mediautils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// number and length in seconds of the clips of each rendition compared against the source
+const qualitySampleCount = 3
+const qualitySampleDuration = 5
+
+// psnr of identical frames is infinite, which json cannot represent
+const maxPSNR = 100
+
+var psnrRegexp = regexp.MustCompile(`PSNR .*average:(\S+)`)
+var ssimRegexp = regexp.MustCompile(`SSIM .*All:([0-9.]+)`)
+var vmafRegexp = regexp.MustCompile(`VMAF score: ([0-9.]+)`)
+
+// QualityScores are objective quality metrics of a rendition against the source
+type QualityScores struct {
+	PSNR float64 `json:"psnr"`
+	SSIM float64 `json:"ssim"`
+	// nil when the local ffmpeg build has no libvmaf
+	VMAF *float64 `json:"vmaf,omitempty"`
+}
+
+type QualitySample struct {
+	sampleClip
+	QualityScores
+}
+
+// RenditionQuality holds the mean scores of a rendition over the sampled clips
+type RenditionQuality struct {
+	Rendition string `json:"rendition"`
+	QualityScores
+	Samples []QualitySample `json:"samples,omitempty"`
+}
+
+type QualityReport struct {
+	Renditions []RenditionQuality `json:"renditions"`
+}
+
+// Summary returns the mean scores of every rendition without the individual samples
+func (r *QualityReport) Summary() []RenditionQuality {
+	summary := make([]RenditionQuality, 0, len(r.Renditions))
+	for _, rendition := range r.Renditions {
+		rendition.Samples = nil
+		summary = append(summary, rendition)
+	}
+	return summary
+}
+
+func (r *QualityReport) JSON() (string, error) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+var filtersLock sync.Mutex
+var filters map[string]bool
+
+// availableFilters lists the filters of the local ffmpeg build, cached and queried detached from ctx
+// the same way as availableEncoders
+func availableFilters() (map[string]bool, error) {
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+
+	if filters != nil {
+		return filters, nil
+	}
+
+	out, err := exec.CommandContext(context.Background(), "ffmpeg", "-hide_banner", "-filters").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	available := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// lines look like " ... libvmaf           VV->V      Calculate the VMAF between two video streams."
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		available[fields[1]] = true
+	}
+	filters = available
+
+	return filters, nil
+}
+
+// qualityFilterGraph scales the rendition back to the size of the source and compares them, in that order
+// as libvmaf expects the distorted stream first
+func qualityFilterGraph(vmaf bool) string {
+	metrics := []string{"psnr", "ssim"}
+	if vmaf {
+		metrics = append(metrics, "libvmaf")
+	}
+
+	distorted := ""
+	reference := ""
+	for i := range metrics {
+		distorted += fmt.Sprintf("[d%d]", i)
+		reference += fmt.Sprintf("[r%d]", i)
+	}
+
+	graph := "[0:v]setpts=PTS-STARTPTS[dist];[1:v]setpts=PTS-STARTPTS[ref];" +
+		"[dist][ref]scale2ref=flags=bicubic[scaled][source];" +
+		fmt.Sprintf("[scaled]setsar=1,split=%d%s;", len(metrics), distorted) +
+		fmt.Sprintf("[source]setsar=1,split=%d%s", len(metrics), reference)
+
+	for i, metric := range metrics {
+		graph += fmt.Sprintf(";[d%d][r%d]%s", i, i, metric)
+	}
+
+	return graph
+}
+
+func parseScore(re *regexp.Regexp, log string) (float64, error) {
+	match := re.FindStringSubmatch(log)
+	if match == nil {
+		return 0, fmt.Errorf("no score matching %s in ffmpeg output", re)
+	}
+	score, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return score, nil
+}
+
+// measureQuality compares a clip of a rendition playlist against the same clip of the source
+func measureQuality(ctx context.Context, playlistFileName, videoFileName string, clip sampleClip, vmaf bool) (*QualityScores, error) {
+	offset := fmt.Sprintf("%.3f", clip.Offset)
+	duration := fmt.Sprintf("%.3f", clip.Duration)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner",
+		"-nostats",
+		"-ss", offset, "-t", duration, "-i", playlistFileName,
+		"-ss", offset, "-t", duration, "-i", videoFileName,
+		"-filter_complex", qualityFilterGraph(vmaf),
+		"-f", "null", "-",
+	)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %s", err, stderr.String())
+	}
+
+	out := stderr.String()
+	scores := QualityScores{}
+
+	psnr, err := parseScore(psnrRegexp, out)
+	if err != nil {
+		return nil, err
+	}
+	scores.PSNR = math.Min(psnr, maxPSNR)
+
+	if scores.SSIM, err = parseScore(ssimRegexp, out); err != nil {
+		return nil, err
+	}
+
+	if vmaf {
+		score, err := parseScore(vmafRegexp, out)
+		if err != nil {
+			return nil, err
+		}
+		scores.VMAF = &score
+	}
+
+	return &scores, nil
+}
+
+// MeasureRenditionQuality scores a rendition against the source on clips sampled over its duration
+func MeasureRenditionQuality(ctx context.Context, playlist Playlist, videoFileName string, duration float64, vmaf bool) (*RenditionQuality, error) {
+	quality := RenditionQuality{
+		Rendition: playlist.Rendition.Name,
+	}
+
+	vmafTotal := 0.0
+	for _, clip := range sampleClips(duration, qualitySampleCount, qualitySampleDuration) {
+		scores, err := measureQuality(ctx, playlist.OutputFileName, videoFileName, clip, vmaf)
+		if err != nil {
+			return nil, err
+		}
+
+		quality.Samples = append(quality.Samples, QualitySample{
+			sampleClip:    clip,
+			QualityScores: *scores,
+		})
+		quality.PSNR += scores.PSNR
+		quality.SSIM += scores.SSIM
+		if scores.VMAF != nil {
+			vmafTotal += *scores.VMAF
+		}
+	}
+
+	count := float64(len(quality.Samples))
+	quality.PSNR /= count
+	quality.SSIM /= count
+	if vmaf {
+		vmafMean := vmafTotal / count
+		quality.VMAF = &vmafMean
+	}
+
+	return &quality, nil
+}
+
+// generateQualityReport scores every video rendition against the source. It must run before the
+// playlists are rewritten to their public urls, as ffmpeg reads the segments from the output directory
+func generateQualityReport(ctx context.Context, hlsSegments *HLSSegmentOutput, videoFileName string, opts *TranscodeOptions) (*QualityReport, error) {
+	if opts.OnQualityStart != nil {
+		opts.OnQualityStart()
+	}
+
+	duration := opts.sourceDuration()
+	if duration <= 0 {
+		return nil, fmt.Errorf("unknown duration of source")
+	}
+
+	available, err := availableFilters()
+	if err != nil {
+		return nil, err
+	}
+
+	report := QualityReport{
+		Renditions: []RenditionQuality{},
+	}
+	for _, playlist := range hlsSegments.playlists {
+		quality, err := MeasureRenditionQuality(ctx, playlist, videoFileName, duration, available["libvmaf"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure quality of rendition %s: %w", playlist.Rendition.Name, err)
+		}
+		report.Renditions = append(report.Renditions, *quality)
+	}
+
+	return &report, nil
+}
@@ -0,0 +1,154 @@
+package mediautils
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// crf with maxrate and bufsize as a cap for complex scenes
+const RATE_CONTROL_CAPPED_CRF = "crf"
+
+// average bitrate of b:v constrained by maxrate and bufsize
+const RATE_CONTROL_VBR = "vbr"
+
+// average bitrate of b:v, distributed using the statistics of a first analysis pass
+const RATE_CONTROL_TWO_PASS = "2pass"
+
+// crf values of similar quality for each codec, as their scales differ
+var defaultCRF = map[string]int{
+	CODEC_H264: 23,
+	CODEC_HEVC: 28,
+	CODEC_AV1:  35,
+}
+
+// highest crf accepted by the encoder of each codec
+var maxCRF = map[string]int{
+	CODEC_H264: 51,
+	CODEC_HEVC: 51,
+	CODEC_AV1:  63,
+}
+
+func (r Rendition) rateControl() string {
+	if r.RateControl == "" {
+		return RATE_CONTROL_VBR
+	}
+	return r.RateControl
+}
+
+func (r Rendition) crf() int {
+	if r.CRF > 0 {
+		return r.CRF
+	}
+	if r.Codec == "" {
+		return defaultCRF[CODEC_H264]
+	}
+	return defaultCRF[r.Codec]
+}
+
+// maxRate defaults to the target bitrate for capped crf, where it is the cap, and to 1.5 times of it otherwise
+func (r Rendition) maxRate() string {
+	if r.MaxRate != "" {
+		return r.MaxRate
+	}
+	if r.rateControl() == RATE_CONTROL_CAPPED_CRF {
+		return r.VideoBitRate
+	}
+	return formatBitRate(ParseBitRate(r.VideoBitRate) * 3 / 2)
+}
+
+// bufSize defaults to two seconds at the max rate
+func (r Rendition) bufSize() string {
+	if r.BufSize != "" {
+		return r.BufSize
+	}
+	return formatBitRate(ParseBitRate(r.maxRate()) * 2)
+}
+
+func formatBitRate(bitRate int) string {
+	return fmt.Sprintf("%dk", bitRate/1000)
+}
+
+func setRateControlArgs(kwArgs ffmpeg.KwArgs, rendition Rendition) {
+	switch rendition.rateControl() {
+	case RATE_CONTROL_CAPPED_CRF:
+		kwArgs["crf"] = fmt.Sprintf("%d", rendition.crf())
+		kwArgs["maxrate"] = rendition.maxRate()
+		kwArgs["bufsize"] = rendition.bufSize()
+		// libaom caps constrained quality with b:v rather than maxrate
+		if rendition.encoder == "libaom-av1" {
+			kwArgs["b:v"] = rendition.maxRate()
+		}
+	case RATE_CONTROL_VBR:
+		kwArgs["b:v"] = rendition.VideoBitRate
+		kwArgs["maxrate"] = rendition.maxRate()
+		kwArgs["bufsize"] = rendition.bufSize()
+	case RATE_CONTROL_TWO_PASS:
+		kwArgs["b:v"] = rendition.VideoBitRate
+		// a cap is optional, as two pass already spreads the bitrate evenly
+		if rendition.MaxRate != "" {
+			kwArgs["maxrate"] = rendition.MaxRate
+			kwArgs["bufsize"] = rendition.bufSize()
+		}
+	}
+}
+
+// newPassLogFile returns the prefix of the first pass statistics of a rendition, kept
+// out of the output directory so that they are not uploaded
+func newPassLogFile() string {
+	return filepath.Join(os.TempDir(), "passlog-"+uuid.NewString())
+}
+
+func removePassLogs(passLogFile string) {
+	files, err := filepath.Glob(passLogFile + "*")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func setPassArgs(kwArgs ffmpeg.KwArgs, rendition Rendition, pass int, passLogFile string) {
+	// libx265 only reads pass settings through its own parameters
+	if rendition.encoder == "libx265" {
+		params := fmt.Sprintf("pass=%d:stats=%s", pass, passLogFile+".log")
+		if existing, ok := kwArgs["x265-params"].(string); ok && existing != "" {
+			params = existing + ":" + params
+		}
+		kwArgs["x265-params"] = params
+		return
+	}
+	kwArgs["pass"] = fmt.Sprintf("%d", pass)
+	kwArgs["passlogfile"] = passLogFile
+}
+
+// firstPassKwArgs encodes only the video of a rendition to gather statistics, discarding the output
+func firstPassKwArgs(rendition Rendition, opts *TranscodeOptions, passLogFile string) ffmpeg.KwArgs {
+	kwArgs := encoderKwArgs(rendition, opts)
+	kwArgs["an"] = ""
+	kwArgs["f"] = "null"
+	setPassArgs(kwArgs, rendition, 1, passLogFile)
+	return kwArgs
+}
+
+// withProgressRange maps the progress reported by an encode into [from, to] of the rendition,
+// so that both passes of a two pass encode add up to a single progression
+func withProgressRange(opts *TranscodeOptions, from, to float64) *TranscodeOptions {
+	scaled := *opts
+	if opts.OnRenditionProgress != nil {
+		scaled.OnRenditionProgress = func(rendition Rendition, percent float64) {
+			opts.OnRenditionProgress(rendition, from+percent*(to-from)/100)
+		}
+	}
+	// the rendition has already started with the first pass
+	if from > 0 {
+		scaled.OnRenditionStart = nil
+	}
+	return &scaled
+}
@@ -0,0 +1,67 @@
+package mediautils
+
+import (
+	"reflect"
+	"testing"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+func TestSetRateControlArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		rendition Rendition
+		want      ffmpeg.KwArgs
+	}{
+		{
+			name:      "vbr by default",
+			rendition: Rendition{VideoBitRate: "2800k"},
+			want:      ffmpeg.KwArgs{"b:v": "2800k", "maxrate": "4200k", "bufsize": "8400k"},
+		},
+		{
+			name:      "vbr with an explicit cap",
+			rendition: Rendition{VideoBitRate: "2800k", MaxRate: "3000k", BufSize: "3000k", RateControl: RATE_CONTROL_VBR},
+			want:      ffmpeg.KwArgs{"b:v": "2800k", "maxrate": "3000k", "bufsize": "3000k"},
+		},
+		{
+			name:      "capped crf at the codec default",
+			rendition: Rendition{VideoBitRate: "2800k", Codec: CODEC_HEVC, RateControl: RATE_CONTROL_CAPPED_CRF},
+			want:      ffmpeg.KwArgs{"crf": "28", "maxrate": "2800k", "bufsize": "5600k"},
+		},
+		{
+			name:      "capped crf defaults to the h264 crf",
+			rendition: Rendition{VideoBitRate: "2800k", RateControl: RATE_CONTROL_CAPPED_CRF},
+			want:      ffmpeg.KwArgs{"crf": "23", "maxrate": "2800k", "bufsize": "5600k"},
+		},
+		{
+			name:      "capped crf on libaom",
+			rendition: Rendition{VideoBitRate: "2000k", Codec: CODEC_AV1, RateControl: RATE_CONTROL_CAPPED_CRF, CRF: 40, encoder: "libaom-av1"},
+			want:      ffmpeg.KwArgs{"crf": "40", "maxrate": "2000k", "bufsize": "4000k", "b:v": "2000k"},
+		},
+		{
+			name:      "capped crf on svt-av1",
+			rendition: Rendition{VideoBitRate: "2000k", Codec: CODEC_AV1, RateControl: RATE_CONTROL_CAPPED_CRF, encoder: "libsvtav1"},
+			want:      ffmpeg.KwArgs{"crf": "35", "maxrate": "2000k", "bufsize": "4000k"},
+		},
+		{
+			name:      "two pass without a cap",
+			rendition: Rendition{VideoBitRate: "2800k", RateControl: RATE_CONTROL_TWO_PASS},
+			want:      ffmpeg.KwArgs{"b:v": "2800k"},
+		},
+		{
+			name:      "two pass with a cap",
+			rendition: Rendition{VideoBitRate: "2800k", MaxRate: "3500k", RateControl: RATE_CONTROL_TWO_PASS},
+			want:      ffmpeg.KwArgs{"b:v": "2800k", "maxrate": "3500k", "bufsize": "7000k"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ffmpeg.KwArgs{}
+			setRateControlArgs(got, tt.rendition)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package mediautils
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// generateSegmentsSinglePass encodes every rendition from one ffmpeg filter graph, where the decoded
+// source is split into a scale filter and encoder per rendition. This trades the parallelism of separate
+// processes for decoding the source only once, which is most of the cost of the smaller renditions
+func generateSegmentsSinglePass(ctx context.Context, renditions []Rendition, audioTracks []AudioTrack, outputDir, outputPrefix, storedTempFileName string, opts *TranscodeOptions) ([]Playlist, []AudioPlaylist, error) {
+	input := ffmpeg.Input(storedTempFileName)
+	split := input.Video().Split()
+
+	// two pass renditions are analysed by a separate graph before this one
+	passLogFiles := map[string]string{}
+	for _, rendition := range renditions {
+		if rendition.rateControl() == RATE_CONTROL_TWO_PASS {
+			passLogFile := newPassLogFile()
+			defer removePassLogs(passLogFile)
+			passLogFiles[rendition.Name] = passLogFile
+		}
+	}
+
+	outputs := []*ffmpeg.Stream{}
+	// every rendition is encoded by the same process, so they all report the same progress
+	progressRenditions := []Rendition{}
+
+	playlists := []Playlist{}
+	for i, rendition := range renditions {
+		outputFileName := generateOutputFileName(outputDir, outputPrefix, rendition.Name)
+
+		scaled := split.Get(fmt.Sprintf("%d", i)).
+			Filter("scale", ffmpeg.Args{fmt.Sprintf("%d:%d", rendition.Width, rendition.Height)}).
+			Filter("setsar", ffmpeg.Args{"1"})
+
+		streams := []*ffmpeg.Stream{scaled}
+		// audio is muxed into the rendition unless it has its own renditions
+		if len(opts.AudioLadder) == 0 && len(audioTracks) > 0 {
+			streams = append(streams, input.Get("a:0"))
+		}
+
+		kwArgs := videoKwArgs(rendition, outputFileName, opts)
+		if passLogFile, ok := passLogFiles[rendition.Name]; ok {
+			setPassArgs(kwArgs, rendition, 2, passLogFile)
+		}
+
+		outputs = append(outputs, ffmpeg.Output(streams, outputFileName, kwArgs))
+		progressRenditions = append(progressRenditions, rendition)
+		playlists = append(playlists, Playlist{
+			Rendition:      rendition,
+			OutputFileName: outputFileName,
+		})
+	}
+
+	audioPlaylists := []AudioPlaylist{}
+	for _, audio := range opts.AudioLadder {
+		for _, track := range audioTracks {
+			name := audioPlaylistName(audio, track)
+			outputFileName := generateOutputFileName(outputDir, outputPrefix, name)
+
+			outputs = append(outputs, ffmpeg.Output([]*ffmpeg.Stream{input.Get(fmt.Sprintf("a:%d", track.Index))}, outputFileName, audioKwArgs(audio, outputFileName, opts)))
+			progressRenditions = append(progressRenditions, Rendition{
+				Name:         name,
+				AudioBitRate: audio.BitRate,
+			})
+			audioPlaylists = append(audioPlaylists, AudioPlaylist{
+				Rendition:      audio,
+				Track:          track,
+				OutputFileName: outputFileName,
+			})
+		}
+	}
+
+	for _, rendition := range progressRenditions {
+		if opts.OnRenditionStart != nil {
+			opts.OnRenditionStart(rendition)
+		}
+	}
+
+	progressFrom := 0.0
+	if len(passLogFiles) > 0 {
+		if err := firstPassSinglePass(ctx, renditions, passLogFiles, storedTempFileName, progressRenditions, opts); err != nil {
+			return nil, nil, err
+		}
+		progressFrom = 50
+	}
+
+	stream := ffmpeg.MergeOutputs(outputs...)
+
+	if opts.OnRenditionProgress != nil {
+		stream = stream.GlobalArgs("-progress", "pipe:1", "-nostats").WithOutput(newProgressWriter(opts.Duration, func(percent float64) {
+			for _, rendition := range progressRenditions {
+				opts.OnRenditionProgress(rendition, progressFrom+percent*(100-progressFrom)/100)
+			}
+		}))
+	}
+
+	if err := runFFmpeg(ctx, stream); err != nil {
+		return nil, nil, err
+	}
+
+	return playlists, audioPlaylists, nil
+}
+
+// firstPassSinglePass runs the analysis pass of every two pass rendition from one filter graph,
+// writing the statistics of each to its file in passLogFiles
+func firstPassSinglePass(ctx context.Context, renditions []Rendition, passLogFiles map[string]string, storedTempFileName string, progressRenditions []Rendition, opts *TranscodeOptions) error {
+	twoPass := []Rendition{}
+	for _, rendition := range renditions {
+		if _, ok := passLogFiles[rendition.Name]; ok {
+			twoPass = append(twoPass, rendition)
+		}
+	}
+
+	split := ffmpeg.Input(storedTempFileName).Video().Split()
+
+	outputs := []*ffmpeg.Stream{}
+	for i, rendition := range twoPass {
+		scaled := split.Get(fmt.Sprintf("%d", i)).
+			Filter("scale", ffmpeg.Args{fmt.Sprintf("%d:%d", rendition.Width, rendition.Height)}).
+			Filter("setsar", ffmpeg.Args{"1"})
+
+		outputs = append(outputs, ffmpeg.Output([]*ffmpeg.Stream{scaled}, os.DevNull, firstPassKwArgs(rendition, opts, passLogFiles[rendition.Name])))
+	}
+
+	stream := ffmpeg.MergeOutputs(outputs...)
+
+	// the first pass takes the first half of the progress of every rendition
+	if opts.OnRenditionProgress != nil {
+		stream = stream.GlobalArgs("-progress", "pipe:1", "-nostats").WithOutput(newProgressWriter(opts.Duration, func(percent float64) {
+			for _, rendition := range progressRenditions {
+				opts.OnRenditionProgress(rendition, percent/2)
+			}
+		}))
+	}
+
+	return runFFmpeg(ctx, stream)
+}
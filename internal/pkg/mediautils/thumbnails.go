@@ -0,0 +1,145 @@
+package mediautils
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+	fileutils "github.com/zihaolam/golang-media-upload-server/internal/pkg/file"
+)
+
+// width of each thumbnail, the height follows the display aspect ratio of the source
+const thumbnailWidth = 160
+
+// thumbnails per row and column of a sprite sheet
+const spriteColumns = 10
+const spriteRows = 10
+
+// ThumbnailOptions configures the sprite sheets and WebVTT track used for scrubbing previews
+type ThumbnailOptions struct {
+	// seconds between captured frames
+	Interval int `json:"interval"`
+	// IMAGE_FORMAT_JPEG, IMAGE_FORMAT_PNG or IMAGE_FORMAT_WEBP
+	Format string `json:"format"`
+}
+
+// ThumbnailTrack is a WebVTT file whose cues point into the sprite sheets with #xywh media fragments
+type ThumbnailTrack struct {
+	TrackFileName   string
+	SpriteFileNames []string
+}
+
+func formatVTTTimestamp(seconds float64) string {
+	milliseconds := int(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", milliseconds/3600000, milliseconds/60000%60, milliseconds/1000%60, milliseconds%1000)
+}
+
+// generateThumbnailTrack writes a cue per captured frame, where the sprites are referenced relative
+// to the track as they are uploaded next to it
+func generateThumbnailTrack(sprites []string, duration float64, interval int, width, height int) string {
+	track := "WEBVTT\n"
+
+	perSprite := spriteColumns * spriteRows
+	for i := 0; float64(i*interval) < duration && i/perSprite < len(sprites); i++ {
+		start := float64(i * interval)
+		end := math.Min(float64((i+1)*interval), duration)
+		position := i % perSprite
+
+		track += fmt.Sprintf("\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatVTTTimestamp(start),
+			formatVTTTimestamp(end),
+			filepath.Base(sprites[i/perSprite]),
+			position%spriteColumns*width,
+			position/spriteColumns*height,
+			width,
+			height,
+		)
+	}
+
+	return track
+}
+
+// GenerateThumbnails captures a frame of the source every interval seconds and tiles them into sprite
+// sheets in outputDir, along with a WebVTT track that maps every interval to its thumbnail
+func GenerateThumbnails(ctx context.Context, videoFileName, outputDir, outputPrefix string, source SourceGeometry, duration float64, opts ThumbnailOptions) (*ThumbnailTrack, error) {
+	if !CheckValidImageFormat(opts.Format) {
+		return nil, fmt.Errorf("invalid image output format")
+	}
+	if opts.Interval <= 0 {
+		return nil, fmt.Errorf("invalid thumbnail interval %d", opts.Interval)
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("unknown duration of source")
+	}
+
+	width := thumbnailWidth
+	height := evenDimension(float64(width) * float64(source.Height) / float64(source.Width))
+	if source.portrait() {
+		// portrait thumbnails are limited by their height instead, so the sprites stay a usable size
+		height = thumbnailWidth
+		width = evenDimension(float64(height) * float64(source.Width) / float64(source.Height))
+	}
+
+	spriteFileName := fmt.Sprintf("%s/%s_sprite_%%03d.%s", outputDir, outputPrefix, opts.Format)
+
+	kwArgs := ffmpeg.KwArgs{
+		"f": "image2",
+	}
+	if opts.Format == IMAGE_FORMAT_JPEG {
+		kwArgs["q:v"] = "3"
+	} else {
+		kwArgs["compression_level"] = "6"
+	}
+
+	stream := ffmpeg.Input(videoFileName).
+		Filter("fps", ffmpeg.Args{fmt.Sprintf("1/%d", opts.Interval)}).
+		Filter("scale", ffmpeg.Args{fmt.Sprintf("%d:%d", width, height)}).
+		Filter("setsar", ffmpeg.Args{"1"}).
+		Filter("tile", ffmpeg.Args{fmt.Sprintf("%dx%d", spriteColumns, spriteRows)}).
+		Output(spriteFileName, kwArgs)
+
+	if err := runFFmpeg(ctx, stream); err != nil {
+		return nil, err
+	}
+
+	sprites, err := filepath.Glob(strings.Replace(spriteFileName, "%03d", "*", 1))
+	if err != nil {
+		return nil, err
+	}
+	if len(sprites) == 0 {
+		return nil, fmt.Errorf("no thumbnails were captured")
+	}
+	sort.Strings(sprites)
+
+	trackFileName := fmt.Sprintf("%s/%s_thumbnails.vtt", outputDir, outputPrefix)
+	if err := fileutils.WriteToFile(trackFileName, generateThumbnailTrack(sprites, duration, opts.Interval, width, height)); err != nil {
+		return nil, err
+	}
+
+	return &ThumbnailTrack{
+		TrackFileName:   trackFileName,
+		SpriteFileNames: sprites,
+	}, nil
+}
+
+// generateThumbnails generates the thumbnails of a transcode in its output directory, when they were requested
+func generateThumbnails(ctx context.Context, videoFileName, outputDir, outputPrefix string, opts *TranscodeOptions) (*ThumbnailTrack, error) {
+	if opts.Thumbnails == nil || opts.Probe == nil {
+		return nil, nil
+	}
+
+	source, ok := NewSourceGeometry(opts.Probe, probeRotation(ctx, videoFileName))
+	if !ok {
+		return nil, fmt.Errorf("source has no video stream to capture thumbnails from")
+	}
+
+	if opts.OnThumbnailStart != nil {
+		opts.OnThumbnailStart()
+	}
+
+	return GenerateThumbnails(ctx, videoFileName, outputDir, outputPrefix, source, opts.sourceDuration(), *opts.Thumbnails)
+}
@@ -0,0 +1,99 @@
+package mediautils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatVTTTimestamp(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{seconds: 0, want: "00:00:00.000"},
+		{seconds: 9.5, want: "00:00:09.500"},
+		{seconds: 61.0004, want: "00:01:01.000"},
+		{seconds: 3725.25, want: "01:02:05.250"},
+	}
+
+	for _, tt := range tests {
+		if got := formatVTTTimestamp(tt.seconds); got != tt.want {
+			t.Errorf("formatVTTTimestamp(%v) = %s, want %s", tt.seconds, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateThumbnailTrack(t *testing.T) {
+	tests := []struct {
+		name     string
+		sprites  []string
+		duration float64
+		interval int
+		wantCues int
+		want     string
+	}{
+		{
+			name:     "last cue ends with the source",
+			sprites:  []string{"/tmp/out/video_sprite_001.jpeg"},
+			duration: 25,
+			interval: 10,
+			wantCues: 3,
+			want: `WEBVTT
+
+00:00:00.000 --> 00:00:10.000
+video_sprite_001.jpeg#xywh=0,0,160,90
+
+00:00:10.000 --> 00:00:20.000
+video_sprite_001.jpeg#xywh=160,0,160,90
+
+00:00:20.000 --> 00:00:25.000
+video_sprite_001.jpeg#xywh=320,0,160,90
+`,
+		},
+		{
+			name:     "no cue past a sprite that was not captured",
+			sprites:  []string{"/tmp/out/video_sprite_001.jpeg"},
+			duration: 1000,
+			interval: 5,
+			wantCues: spriteColumns * spriteRows,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := generateThumbnailTrack(tt.sprites, tt.duration, tt.interval, 160, 90)
+			if tt.want != "" && got != tt.want {
+				t.Fatalf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if cues := strings.Count(got, " --> "); cues != tt.wantCues {
+				t.Fatalf("got %d cues, want %d", cues, tt.wantCues)
+			}
+		})
+	}
+}
+
+func TestGenerateThumbnailTrackTiles(t *testing.T) {
+	sprites := []string{"/tmp/out/video_sprite_001.jpeg", "/tmp/out/video_sprite_002.jpeg"}
+	track := generateThumbnailTrack(sprites, 2000, 10, 160, 90)
+	cues := strings.Split(strings.TrimPrefix(track, "WEBVTT\n\n"), "\n\n")
+
+	tests := []struct {
+		cue  int
+		want string
+	}{
+		{cue: 9, want: "video_sprite_001.jpeg#xywh=1440,0,160,90"},
+		{cue: 10, want: "video_sprite_001.jpeg#xywh=0,90,160,90"},
+		{cue: 99, want: "video_sprite_001.jpeg#xywh=1440,810,160,90"},
+		{cue: 100, want: "video_sprite_002.jpeg#xywh=0,0,160,90"},
+		{cue: 123, want: "video_sprite_002.jpeg#xywh=480,180,160,90"},
+	}
+
+	if len(cues) != 200 {
+		t.Fatalf("got %d cues, want 200", len(cues))
+	}
+	for _, tt := range tests {
+		if got := strings.Split(strings.TrimSpace(cues[tt.cue]), "\n")[1]; got != tt.want {
+			t.Errorf("cue %d points to %s, want %s", tt.cue, got, tt.want)
+		}
+	}
+}
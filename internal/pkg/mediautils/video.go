@@ -5,141 +5,404 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
-	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	ffmpeg "github.com/u2takey/ffmpeg-go"
+	ffprobe "github.com/vansante/go-ffprobe"
 	"github.com/zihaolam/golang-media-upload-server/internal"
 	fileutils "github.com/zihaolam/golang-media-upload-server/internal/pkg/file"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/retry"
 	"github.com/zihaolam/golang-media-upload-server/internal/pkg/s3"
 )
 
-type Resolution struct {
-	Resolution   string
-	VideoBitRate string
-	AudioBitRate string
-	Bandwidth    string
+const SEGMENT_FORMAT_TS = "ts"
+const SEGMENT_FORMAT_FMP4 = "fmp4"
+
+var segmentFormats = []string{SEGMENT_FORMAT_TS, SEGMENT_FORMAT_FMP4}
+
+func CheckValidSegmentFormat(segmentFormat string) bool {
+	for _, format := range segmentFormats {
+		if format == segmentFormat {
+			return true
+		}
+	}
+	return false
 }
 
 type Playlist struct {
-	Resolution     Resolution
+	Rendition      Rendition
+	OutputFileName string
+	// measured from the encoded segments, nil if they could not be inspected
+	Info *PlaylistInfo
+	// trick play playlist over the keyframes of the segments, nil if it could not be generated
+	IFrames *IFramePlaylist
+}
+
+type AudioPlaylist struct {
+	Rendition      AudioRendition
+	Track          AudioTrack
 	OutputFileName string
+	Info           *PlaylistInfo
+}
+
+type TranscodeOptions struct {
+	// duration of the source video in seconds, used to compute encode progress
+	Duration float64
+	// renditions to encode, the default ladder is used when empty
+	Ladder []Rendition
+	// audio renditions shared by every video rendition through an audio group, with one
+	// playlist per audio track of the source. Audio is muxed into each video rendition
+	// when empty and the source has a single audio track
+	AudioLadder []AudioRendition
+	// SEGMENT_FORMAT_TS for mpeg-ts segments or SEGMENT_FORMAT_FMP4 for fragmented mp4 (cmaf)
+	// segments with an init segment per playlist, mpeg-ts is used when empty
+	SegmentFormat string
+	// also writes a dash manifest over the same segments, which requires SEGMENT_FORMAT_FMP4
+	Dash bool
+	// encodes every rendition from a single ffmpeg process that decodes the source once,
+	// instead of one process per rendition
+	SinglePass bool
+	// scales the ladder bitrates to the complexity of the source, measured by probe encodes of
+	// a few sampled clips. Requires Probe, and the static ladder is used if the analysis fails
+	PerTitle bool
+	// scores every rendition against the source with psnr, ssim and vmaf when available,
+	// written as a json report next to the master playlist
+	QualityReport bool
+	// captures thumbnail sprite sheets and a WebVTT track for scrubbing previews, none when nil
+	Thumbnails *ThumbnailOptions
+	// picks a detailed frame that is not black or blurry as the poster, in several sizes and formats
+	Poster bool
+	// ffprobe data of the source, used to skip renditions that would upscale it
+	// and to size renditions to the display aspect ratio of the source
+	Probe *ffprobe.ProbeData
+	// called when the per title complexity analysis starts
+	OnAnalysisStart func()
+	// called when the quality of the renditions starts being measured
+	OnQualityStart func()
+	// called when the thumbnails start being captured
+	OnThumbnailStart func()
+	// called when the poster frame starts being chosen
+	OnPosterStart func()
+	// called when a rendition starts encoding
+	OnRenditionStart func(rendition Rendition)
+	// called periodically with the percentage of a rendition that has been encoded
+	OnRenditionProgress func(rendition Rendition, percent float64)
+	// called once every rendition is encoded and the upload to s3 begins
+	OnUploadStart func()
+}
+
+// sourceDuration is the duration of the source in seconds, taken from the probe when it was not given
+func (opts *TranscodeOptions) sourceDuration() float64 {
+	if opts.Duration == 0 && opts.Probe != nil && opts.Probe.Format != nil {
+		return opts.Probe.Format.DurationSeconds
+	}
+	return opts.Duration
+}
+
+// TranscodeResult holds the public urls of a transcoded video
+type TranscodeResult struct {
+	MasterPlaylistUrl string
+	// empty unless a dash manifest was requested
+	DashManifestUrl string
+	// renditions that were encoded, after pruning and per title bitrates
+	Ladder []Rendition
+	// nil unless the per title analysis succeeded
+	Complexity *ComplexityAnalysis
+	// empty unless a quality report was requested and could be measured
+	QualityReportUrl string
+	Quality          []RenditionQuality
+	// empty unless thumbnails were requested
+	ThumbnailTrackUrl   string
+	ThumbnailSpriteUrls []string
+	// largest jpeg poster, with every size and format in PosterImages
+	PosterUrl    string
+	PosterImages []PosterImage
 }
 
 type HLSSegmentOutput struct {
 	playlists      []Playlist
+	audioPlaylists []AudioPlaylist
 	masterPlaylist string
+	complexity     *ComplexityAnalysis
+}
+
+// Ladder returns the renditions that were encoded
+func (o *HLSSegmentOutput) Ladder() []Rendition {
+	ladder := make([]Rendition, 0, len(o.playlists))
+	for _, playlist := range o.playlists {
+		ladder = append(ladder, playlist.Rendition)
+	}
+	return ladder
+}
+
+// encodeHLS runs a single ffmpeg hls encode, reporting progress under the given rendition
+func encodeHLS(ctx context.Context, rendition Rendition, outputFileName string, tempVideoFileName string, kwArgs ffmpeg.KwArgs, opts *TranscodeOptions) error {
+	if opts.OnRenditionStart != nil {
+		opts.OnRenditionStart(rendition)
+	}
+
+	stream := ffmpeg.Input(tempVideoFileName).Output(outputFileName, kwArgs)
+
+	if opts.OnRenditionProgress != nil {
+		stream = stream.GlobalArgs("-progress", "pipe:1", "-nostats").WithOutput(newProgressWriter(opts.Duration, func(percent float64) {
+			opts.OnRenditionProgress(rendition, percent)
+		}))
+	}
+
+	return runFFmpeg(ctx, stream)
 }
 
-var resolutions = []Resolution{
-	{
-		Resolution:   "320x180",
-		VideoBitRate: "500k",
-		Bandwidth:    "676800",
-		AudioBitRate: "64k",
-	},
-	{
-		Resolution:   "854x480",
-		VideoBitRate: "1000k",
-		Bandwidth:    "1353600",
-		AudioBitRate: "128k",
-	},
-	{
-		Resolution:   "1280x720",
-		VideoBitRate: "2500k",
-		AudioBitRate: "192k",
-		Bandwidth:    "3230400",
-	},
-}
-
-func generateHLSSegments(resolution Resolution, playlistCh chan Playlist, errCh chan error, wg *sync.WaitGroup, outputDir string, outputPrefix string, tempVideoFileName string) {
-	defer wg.Done()
-	outputFileName := generateOutputFileName(outputDir, outputPrefix, resolution.Resolution)
+func hlsKwArgs(outputFileName string, segmentFormat string) ffmpeg.KwArgs {
 	segmentFileName := strings.Replace(outputFileName, ".m3u8", "_m3u8", 1)
-	err := ffmpeg.Input(tempVideoFileName).Output(outputFileName, ffmpeg.KwArgs{
-		"c:v":                  "h264",
-		"b:v":                  resolution.VideoBitRate,
-		"c:a":                  "aac",
-		"b:a":                  resolution.AudioBitRate,
-		"vf":                   "scale=" + resolution.Resolution,
+	kwArgs := ffmpeg.KwArgs{
 		"f":                    "hls",
-		"hls_time":             "10",
+		"hls_time":             fmt.Sprintf("%d", hlsSegmentDuration),
 		"hls_list_size":        "0",
-		"crf":                  "20",
 		"hls_segment_filename": segmentFileName + "_%03d.ts",
-	}).Run()
+	}
 
-	if err != nil {
-		errCh <- err
-		return
+	if segmentFormat == SEGMENT_FORMAT_FMP4 {
+		kwArgs["hls_segment_type"] = "fmp4"
+		kwArgs["hls_segment_filename"] = segmentFileName + "_%03d.m4s"
+		// written next to the segments and referenced by EXT-X-MAP
+		kwArgs["hls_fmp4_init_filename"] = filepath.Base(segmentFileName) + "_init.mp4"
+	}
+
+	return kwArgs
+}
+
+// encoderKwArgs builds the video encoder arguments of a rendition, apart from its scaling
+func encoderKwArgs(rendition Rendition, opts *TranscodeOptions) ffmpeg.KwArgs {
+	kwArgs := ffmpeg.KwArgs{
+		"c:v": rendition.encoder,
+	}
+
+	setKeyframeArgs(kwArgs, rendition, sourceFrameRate(opts.Probe))
+	setRateControlArgs(kwArgs, rendition)
+
+	if rendition.Codec == CODEC_HEVC {
+		// apple players only accept hevc tagged as hvc1
+		kwArgs["tag:v"] = "hvc1"
+	}
+
+	if rendition.Profile != "" {
+		kwArgs["profile:v"] = rendition.Profile
 	}
 
-	playlistCh <- Playlist{
-		Resolution:     resolution,
+	return kwArgs
+}
+
+// videoKwArgs builds the encoder and hls arguments of a video rendition, apart from its scaling
+func videoKwArgs(rendition Rendition, outputFileName string, opts *TranscodeOptions) ffmpeg.KwArgs {
+	kwArgs := hlsKwArgs(outputFileName, opts.SegmentFormat)
+	for key, value := range encoderKwArgs(rendition, opts) {
+		kwArgs[key] = value
+	}
+
+	// audio is encoded once into its own renditions when an audio ladder is given
+	if len(opts.AudioLadder) > 0 {
+		kwArgs["an"] = ""
+	} else {
+		kwArgs["c:a"] = "aac"
+		kwArgs["b:a"] = rendition.AudioBitRate
+	}
+
+	return kwArgs
+}
+
+func generateHLSSegments(ctx context.Context, rendition Rendition, outputDir string, outputPrefix string, tempVideoFileName string, opts *TranscodeOptions) (*Playlist, error) {
+	outputFileName := generateOutputFileName(outputDir, outputPrefix, rendition.Name)
+	scale := fmt.Sprintf("scale=%d:%d,setsar=1", rendition.Width, rendition.Height)
+	kwArgs := videoKwArgs(rendition, outputFileName, opts)
+	kwArgs["vf"] = scale
+
+	if rendition.rateControl() == RATE_CONTROL_TWO_PASS {
+		passLogFile := newPassLogFile()
+		defer removePassLogs(passLogFile)
+
+		firstPass := firstPassKwArgs(rendition, opts, passLogFile)
+		firstPass["vf"] = scale
+		if err := encodeHLS(ctx, rendition, os.DevNull, tempVideoFileName, firstPass, withProgressRange(opts, 0, 50)); err != nil {
+			return nil, err
+		}
+
+		setPassArgs(kwArgs, rendition, 2, passLogFile)
+		opts = withProgressRange(opts, 50, 100)
+	}
+
+	if err := encodeHLS(ctx, rendition, outputFileName, tempVideoFileName, kwArgs, opts); err != nil {
+		return nil, err
+	}
+
+	return &Playlist{
+		Rendition:      rendition,
 		OutputFileName: outputFileName,
+	}, nil
+}
+
+// audioPlaylistName names the playlist of an audio rendition of a track, which is also used to report its progress
+func audioPlaylistName(audio AudioRendition, track AudioTrack) string {
+	return fmt.Sprintf("%s_%d", audio.Name, track.Index)
+}
+
+func audioKwArgs(audio AudioRendition, outputFileName string, opts *TranscodeOptions) ffmpeg.KwArgs {
+	kwArgs := hlsKwArgs(outputFileName, opts.SegmentFormat)
+	kwArgs["c:a"] = "aac"
+	kwArgs["b:a"] = audio.BitRate
+	return kwArgs
+}
+
+func generateAudioHLSSegments(ctx context.Context, audio AudioRendition, track AudioTrack, outputDir string, outputPrefix string, tempVideoFileName string, opts *TranscodeOptions) (*AudioPlaylist, error) {
+	name := audioPlaylistName(audio, track)
+	outputFileName := generateOutputFileName(outputDir, outputPrefix, name)
+	kwArgs := audioKwArgs(audio, outputFileName, opts)
+	kwArgs["map"] = fmt.Sprintf("0:a:%d", track.Index)
+
+	progressRendition := Rendition{
+		Name:         name,
+		AudioBitRate: audio.BitRate,
+	}
+
+	if err := encodeHLS(ctx, progressRendition, outputFileName, tempVideoFileName, kwArgs, opts); err != nil {
+		return nil, err
 	}
+
+	return &AudioPlaylist{
+		Rendition:      audio,
+		Track:          track,
+		OutputFileName: outputFileName,
+	}, nil
 }
 
-func generateOutputFileName(outputDir, outputName string, resolution string) string {
-	return fmt.Sprintf("%s/%s_%s.m3u8", outputDir, outputName, resolution)
+func generateOutputFileName(outputDir, outputName string, renditionName string) string {
+	return fmt.Sprintf("%s/%s_%s.m3u8", outputDir, outputName, renditionName)
 }
 
-func generateMasterPlaylist(playlists *[]Playlist, outputDir string) string {
+func generateMasterPlaylist(playlists *[]Playlist, audioPlaylists []AudioPlaylist, outputDir string) string {
 	masterPlaylist := "#EXTM3U\n"
+	for _, audioPlaylist := range audioPlaylists {
+		playlistFileName := strings.Replace(audioPlaylist.OutputFileName, outputDir+"/", "", 1)
+		masterPlaylist += fmt.Sprintf("%s,URI=\"%s\"\n", audioMedia(audioPlaylist), playlistFileName)
+	}
 	for _, playlist := range *playlists {
 		playlistFileName := strings.Replace(playlist.OutputFileName, outputDir+"/", "", 1)
-		masterPlaylist += fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%s,RESOLUTION=%s\n%s\n", playlist.Resolution.Bandwidth, playlist.Resolution.Resolution, playlistFileName)
+		masterPlaylist += fmt.Sprintf("%s\n%s\n", streamInf(playlist, selectAudioPlaylist(playlist.Rendition, audioPlaylists)), playlistFileName)
+	}
+	for _, playlist := range *playlists {
+		if playlist.IFrames != nil {
+			masterPlaylist += iframeStreamInf(playlist, outputDir) + "\n"
+		}
 	}
 	return masterPlaylist
 }
 
-func generateSegmentsForResolutions(resolutions []Resolution, outputDir, outputPrefix, storedTempFileName string) (*HLSSegmentOutput, error) {
-	playlistArr := []Playlist{}
+// generateSegmentsInParallel runs one ffmpeg process per rendition, each decoding the source on its own
+func generateSegmentsInParallel(ctx context.Context, renditions []Rendition, audioTracks []AudioTrack, outputDir, outputPrefix, storedTempFileName string, opts *TranscodeOptions) ([]Playlist, []AudioPlaylist, error) {
+	playlistArr := make([]Playlist, len(renditions))
+	audioPlaylistArr := make([]AudioPlaylist, len(opts.AudioLadder)*len(audioTracks))
+
+	// stops the remaining ffmpeg processes as soon as one rendition fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	playlistCh := make(chan Playlist)
-	errorCh := make(chan error)
+	errorCh := make(chan error, len(playlistArr)+len(audioPlaylistArr))
 
 	var wg sync.WaitGroup
-	for _, resolution := range resolutions {
+	for i, rendition := range renditions {
 		wg.Add(1)
-		go generateHLSSegments(resolution, playlistCh, errorCh, &wg, outputDir, outputPrefix, storedTempFileName)
+		go func(i int, rendition Rendition) {
+			defer wg.Done()
+			playlist, err := generateHLSSegments(ctx, rendition, outputDir, outputPrefix, storedTempFileName, opts)
+			if err != nil {
+				errorCh <- err
+				cancel()
+				return
+			}
+			playlistArr[i] = *playlist
+		}(i, rendition)
 	}
 
-	go func() {
-		wg.Wait()
-		close(playlistCh)
-		close(errorCh)
-	}()
+	for i, audio := range opts.AudioLadder {
+		for j, track := range audioTracks {
+			wg.Add(1)
+			go func(i int, audio AudioRendition, track AudioTrack) {
+				defer wg.Done()
+				audioPlaylist, err := generateAudioHLSSegments(ctx, audio, track, outputDir, outputPrefix, storedTempFileName, opts)
+				if err != nil {
+					errorCh <- err
+					cancel()
+					return
+				}
+				audioPlaylistArr[i] = *audioPlaylist
+			}(i*len(audioTracks)+j, audio, track)
+		}
+	}
 
-	for {
-		select {
-		case playlist, ok := <-playlistCh:
-			if !ok {
-				playlistCh = nil
-				break
-			}
-			playlistArr = append(playlistArr, playlist)
-		case err, ok := <-errorCh:
-			if !ok {
-				errorCh = nil
-				break
-			}
-			if err != nil {
-				return nil, err
-			}
+	wg.Wait()
+	close(errorCh)
+
+	// the first error is the cause, the others are usually the cancellation it triggered
+	if err := <-errorCh; err != nil {
+		return nil, nil, err
+	}
+
+	return playlistArr, audioPlaylistArr, nil
+}
+
+func generateSegmentsForResolutions(ctx context.Context, renditions []Rendition, audioTracks []AudioTrack, outputDir, outputPrefix, storedTempFileName string, opts *TranscodeOptions) (*HLSSegmentOutput, error) {
+	generateSegments := generateSegmentsInParallel
+	if opts.SinglePass {
+		generateSegments = generateSegmentsSinglePass
+	}
+
+	playlistArr, audioPlaylistArr, err := generateSegments(ctx, renditions, audioTracks, outputDir, outputPrefix, storedTempFileName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range playlistArr {
+		info, err := describePlaylist(ctx, playlistArr[i].OutputFileName)
+		if err != nil {
+			log.Println(err)
+			continue
 		}
-		if errorCh == nil && playlistCh == nil {
-			break
+		playlistArr[i].Info = info
+	}
+
+	// players fall back to scrubbing the media playlists without I-frame playlists, so they are optional
+	for i := range playlistArr {
+		iframes, err := generateIFramePlaylist(ctx, playlistArr[i])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		playlistArr[i].IFrames = iframes
+	}
+
+	for i := range audioPlaylistArr {
+		info, err := describePlaylist(ctx, audioPlaylistArr[i].OutputFileName)
+		if err != nil {
+			log.Println(err)
+			continue
 		}
+		audioPlaylistArr[i].Info = info
 	}
 
-	masterPlaylist := generateMasterPlaylist(&playlistArr, outputDir)
+	// list the variants from the lowest bitrate
+	sort.SliceStable(playlistArr, func(i, j int) bool {
+		return playlistArr[i].Rendition.Bandwidth() < playlistArr[j].Rendition.Bandwidth()
+	})
+
+	masterPlaylist := generateMasterPlaylist(&playlistArr, audioPlaylistArr, outputDir)
 
 	return &HLSSegmentOutput{
 		playlists:      playlistArr,
+		audioPlaylists: audioPlaylistArr,
 		masterPlaylist: masterPlaylist,
 	}, nil
 }
@@ -155,7 +418,12 @@ func replaceHLSSegmentsBasePath(directory string, basePath string, prefix string
 			if err != nil {
 				return err
 			}
-			content := strings.ReplaceAll(string(fileBytes), basePath, prefix+"/"+basePath)
+			content := rewritePlaylistUris(string(fileBytes), func(uri string) string {
+				if !strings.HasPrefix(uri, basePath) {
+					return uri
+				}
+				return prefix + "/" + uri
+			})
 
 			err = os.WriteFile(path, []byte(content), info.Mode())
 
@@ -172,49 +440,212 @@ func getUploadedS3HLSMasterDirectory(masterPlaylistFileName, tmpDir string) stri
 	return internal.Env.PublicAssetEndpoint + strings.Replace(masterPlaylistFileName, tmpDir, "", 1)
 }
 
+// EncodeHLS encodes the renditions of a video into hls playlists and segments in outputDir, without
+// uploading them. opts is updated with the segment format and audio ladder that were actually used
+func EncodeHLS(ctx context.Context, videoFilename, outputDir, outputPrefix string, opts *TranscodeOptions) (*HLSSegmentOutput, error) {
+	ladder := opts.Ladder
+	if len(ladder) == 0 {
+		defaultLadder, err := GetLadder("")
+		if err != nil {
+			return nil, err
+		}
+		ladder = defaultLadder
+	}
+
+	ladder, err := selectEncoders(ladder)
+	if err != nil {
+		return nil, err
+	}
+
+	// dash players can only share the segments when they are fragmented mp4,
+	// and hls only carries hevc and av1 in fragmented mp4
+	if opts.Dash || requiresFMP4(ladder) {
+		opts.SegmentFormat = SEGMENT_FORMAT_FMP4
+	}
+
+	audioTracks, err := ProbeAudioTracks(ctx, videoFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	// there is nothing to put in an audio group for sources without audio
+	case len(audioTracks) == 0:
+		opts.AudioLadder = nil
+	// every track needs its own rendition, as only one audio track can be muxed into a variant
+	case len(audioTracks) > 1 && len(opts.AudioLadder) == 0:
+		opts.AudioLadder, err = ResolveAudioLadder(true, nil, ladder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var complexity *ComplexityAnalysis
+	if opts.Probe != nil {
+		// ffmpeg applies the rotation while decoding, so the scaled sizes are in display orientation
+		if source, ok := NewSourceGeometry(opts.Probe, probeRotation(ctx, videoFilename)); ok {
+			// bitrates are adapted before pruning, as pruning drops rungs whose bitrate exceeds the source
+			if opts.PerTitle {
+				ladder, complexity = perTitleLadder(ctx, ladder, videoFilename, source, opts)
+			}
+			ladder = ScaleLadder(PruneLadder(ladder, source, sourceVideoBitRate(opts.Probe)), source)
+		}
+	}
+
+	hlsSegments, err := generateSegmentsForResolutions(ctx, ladder, audioTracks, outputDir, outputPrefix, videoFilename, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// misaligned renditions may stall players when they switch, but still play on their own
+	if err := verifySegmentAlignment(hlsSegments); err != nil {
+		log.Printf("warning: %s\n", err)
+	}
+
+	hlsSegments.complexity = complexity
+
+	return hlsSegments, nil
+}
+
 // transcodes video to hls and uploads to s3 bucket
-func TranscodeVideoToHLS(videoFilename, tmpDir string) (string, error) {
+func TranscodeVideoToHLS(ctx context.Context, videoFilename, tmpDir string, opts TranscodeOptions) (*TranscodeResult, error) {
 	fileOutputDirLeaf := uuid.New().String()
 	fileOutputDir := filepath.Join(tmpDir, fileOutputDirLeaf)
 	fileOutputPrefix := uuid.New().String()
 
 	if err := os.MkdirAll(fileOutputDir, os.ModePerm); err != nil {
-		return "", err
+		return nil, err
 	}
 
-	hlsSegments, err := generateSegmentsForResolutions(resolutions, fileOutputDir, fileOutputPrefix, videoFilename)
+	hlsSegments, err := EncodeHLS(ctx, videoFilename, fileOutputDir, fileOutputPrefix, &opts)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	masterPlaylistFileName := fmt.Sprintf("%s/%s_master.m3u8", fileOutputDir, fileOutputPrefix)
 
 	if err := fileutils.WriteToFile(masterPlaylistFileName, hlsSegments.masterPlaylist); err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// a quality report is informational, so failing to measure it does not fail the transcode
+	var qualityReport *QualityReport
+	qualityReportFileName := ""
+	if opts.QualityReport {
+		qualityReport, err = generateQualityReport(ctx, hlsSegments, videoFilename, &opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Println(err)
+		}
+	}
+
+	if qualityReport != nil {
+		report, err := qualityReport.JSON()
+		if err != nil {
+			return nil, err
+		}
+
+		qualityReportFileName = fmt.Sprintf("%s/%s_quality.json", fileOutputDir, fileOutputPrefix)
+		if err := fileutils.WriteToFile(qualityReportFileName, report); err != nil {
+			return nil, err
+		}
+	}
+
+	// players only lose their scrubbing previews without thumbnails, so they don't fail the transcode either
+	thumbnails, err := generateThumbnails(ctx, videoFilename, fileOutputDir, fileOutputPrefix, &opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Println(err)
+	}
+
+	// a missing poster only falls back to the first frame in players, so it does not fail the transcode
+	posterImages, err := generatePoster(ctx, videoFilename, fileOutputDir, fileOutputPrefix, &opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Println(err)
 	}
 
 	newDirPrefix := internal.Env.PublicAssetEndpoint + "/" + fileOutputDirLeaf
 
-	if err = UploadTranscodedSegmentsToS3(fileOutputDir, fileOutputPrefix, newDirPrefix); err != nil {
+	dashManifestFileName := ""
+	if opts.Dash {
+		dashManifest, err := generateDashManifest(hlsSegments, newDirPrefix+"/")
+		if err != nil {
+			return nil, err
+		}
+
+		dashManifestFileName = fmt.Sprintf("%s/%s_manifest.mpd", fileOutputDir, fileOutputPrefix)
+		if err := fileutils.WriteToFile(dashManifestFileName, dashManifest); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.OnUploadStart != nil {
+		opts.OnUploadStart()
+	}
+
+	if err = retry.Do(ctx, retry.StepUpload, retry.PolicyFor(retry.StepUpload), func(ctx context.Context) error {
+		return UploadTranscodedSegmentsToS3(ctx, fileOutputDir, fileOutputPrefix, newDirPrefix)
+	}); err != nil {
 		log.Println(err)
-		return "", fiber.ErrInternalServerError
+		// the context may already be cancelled, so clean up partial uploads with a fresh one
+		if err := s3.NewS3Client().DeleteDirectory(context.Background(), fileOutputDirLeaf+"/"); err != nil {
+			log.Println(err)
+		}
+		return nil, err
+	}
+
+	result := &TranscodeResult{
+		MasterPlaylistUrl: getUploadedS3HLSMasterDirectory(masterPlaylistFileName, tmpDir),
+		Ladder:            hlsSegments.Ladder(),
+		Complexity:        hlsSegments.complexity,
+	}
+
+	if dashManifestFileName != "" {
+		result.DashManifestUrl = getUploadedS3HLSMasterDirectory(dashManifestFileName, tmpDir)
+	}
+
+	if qualityReportFileName != "" {
+		result.QualityReportUrl = getUploadedS3HLSMasterDirectory(qualityReportFileName, tmpDir)
+		result.Quality = qualityReport.Summary()
+	}
+
+	if thumbnails != nil {
+		result.ThumbnailTrackUrl = getUploadedS3HLSMasterDirectory(thumbnails.TrackFileName, tmpDir)
+		for _, sprite := range thumbnails.SpriteFileNames {
+			result.ThumbnailSpriteUrls = append(result.ThumbnailSpriteUrls, getUploadedS3HLSMasterDirectory(sprite, tmpDir))
+		}
 	}
 
-	uploadedDirectory := getUploadedS3HLSMasterDirectory(masterPlaylistFileName, tmpDir)
+	for _, image := range posterImages {
+		image.Url = getUploadedS3HLSMasterDirectory(image.fileName, tmpDir)
+		if result.PosterUrl == "" && image.Format == IMAGE_FORMAT_JPEG {
+			result.PosterUrl = image.Url
+		}
+		result.PosterImages = append(result.PosterImages, image)
+	}
 
-	return uploadedDirectory, nil
+	return result, nil
 }
 
-func UploadTranscodedSegmentsToS3(directory, directoryPrefix, newDirPrefix string) error {
+// UploadTranscodedSegmentsToS3 points the playlists in directory at newDirPrefix and uploads the directory,
+// playlists that were already rewritten are left as is so that the upload can be retried
+func UploadTranscodedSegmentsToS3(ctx context.Context, directory, directoryPrefix, newDirPrefix string) error {
 	s3Client := s3.NewS3Client()
-	ctx := context.Context(context.Background())
 	replaceHLSSegmentsBasePath(directory, directoryPrefix, newDirPrefix)
 	return s3Client.UploadDirectory(ctx, directory)
 }
 
-func ExtractAudio(videoFileName string) (*string, error) {
+// extracts the audio track at the given index among the audio streams of the video
+func ExtractAudio(ctx context.Context, videoFileName string, track int) (*string, error) {
 	audioFileName := strings.Replace(videoFileName, ".mp4", ".mp3", 1)
-	err := ffmpeg.Input(videoFileName).Output(audioFileName, ffmpeg.KwArgs{"map": "0:a"}).Run()
+	err := runFFmpeg(ctx, ffmpeg.Input(videoFileName).Output(audioFileName, ffmpeg.KwArgs{"map": fmt.Sprintf("0:a:%d", track)}))
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -222,3 +653,21 @@ func ExtractAudio(videoFileName string) (*string, error) {
 
 	return &audioFileName, nil
 }
+
+// runs the compiled ffmpeg command, killing the process if ctx is cancelled
+func runFFmpeg(ctx context.Context, stream *ffmpeg.Stream) error {
+	compiled := stream.Compile()
+	cmd := exec.CommandContext(ctx, compiled.Path, compiled.Args[1:]...)
+	cmd.Stdin = compiled.Stdin
+	cmd.Stdout = compiled.Stdout
+	cmd.Stderr = compiled.Stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	return nil
+}
@@ -19,10 +19,9 @@ type SubtitleTrack struct {
 	Language string `json:"language"`
 }
 
-func TranscribeAudio(mp3FileName, outputDir string) (string, error) {
+func TranscribeAudio(ctx context.Context, mp3FileName, outputDir string) (string, error) {
 	client := openai.NewClient(internal.Env.OpenAIApiKey)
 
-	ctx := context.Background()
 	resp, err := client.CreateTranscription(ctx, openai.AudioRequest{
 		Model:    openai.Whisper1,
 		FilePath: mp3FileName,
@@ -45,7 +44,7 @@ func TranscribeAudio(mp3FileName, outputDir string) (string, error) {
 	return f.Name(), nil
 }
 
-func TranslateVTT(vttFileName, language, outputDir string) (string, error) {
+func TranslateVTT(ctx context.Context, vttFileName, language, outputDir string) (string, error) {
 	if language != MandarinTranslationLanguage && language != EnglishTranslationLanguage {
 		return "", fmt.Errorf("invalid language")
 	}
@@ -55,7 +54,6 @@ func TranslateVTT(vttFileName, language, outputDir string) (string, error) {
 	}
 
 	client := openai.NewClient(internal.Env.OpenAIApiKey)
-	ctx := context.Background()
 
 	resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
 		Model: openai.GPT4Turbo,
@@ -0,0 +1,585 @@
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/job"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/mediautils"
+	bolt "go.etcd.io/bbolt"
+)
+
+var jobsBucket = []byte("jobs")
+
+// job ids keyed by sequence number, so jobs can be listed in order without reading every record
+var seqBucket = []byte("jobsBySeq")
+
+// ids of the pending jobs keyed by sequence number, so claims don't have to scan finished jobs
+var pendingBucket = []byte("pendingJobs")
+
+const pruneInterval = time.Hour
+
+var ErrJobNotFound = errors.New("job not found")
+var ErrJobAlreadyQueued = errors.New("job is already queued")
+var ErrQueueFull = errors.New("job queue is full")
+var ErrJobNotPending = errors.New("job is not pending")
+
+const StageQueued = "queued"
+const StageDownloading = "downloading"
+const StageProbing = "probing"
+const StageTranscoding = "transcoding"
+const StageTranscribing = "transcribing"
+const StageTranslating = "translating"
+const StageUploading = "uploading"
+const StageDone = "done"
+const StageFailed = "failed"
+const StageCancelled = "cancelled"
+
+type StageEvent struct {
+	Stage  string    `json:"stage"`
+	Detail string    `json:"detail,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Upload is set for jobs created from a file uploaded directly to this server rather than by the video platform
+type Upload struct {
+	FilePath    string `json:"filePath"`
+	CallbackUrl string `json:"callbackUrl,omitempty"`
+	Transcribe  bool   `json:"transcribe"`
+}
+
+type Options struct {
+	Upload *Upload `json:"upload,omitempty"`
+	// name of the ladder preset that was requested, empty for the default or a custom ladder
+	Profile string                 `json:"profile,omitempty"`
+	Ladder  []mediautils.Rendition `json:"ladder,omitempty"`
+	// audio renditions shared by the ladder, empty when audio is muxed into every rendition
+	AudioLadder []mediautils.AudioRendition `json:"audioLadder,omitempty"`
+	// audio track to transcribe by index or language, the default track of the source when unset
+	TranscribeTrack    *int   `json:"transcribeTrack,omitempty"`
+	TranscribeLanguage string `json:"transcribeLanguage,omitempty"`
+	SegmentFormat      string `json:"segmentFormat,omitempty"`
+	Dash               bool   `json:"dash,omitempty"`
+	SinglePass         bool   `json:"singlePass,omitempty"`
+	PerTitle           bool   `json:"perTitle,omitempty"`
+	QualityReport      bool   `json:"qualityReport,omitempty"`
+	// thumbnail sprites for scrubbing previews, none when nil
+	Thumbnails *mediautils.ThumbnailOptions `json:"thumbnails,omitempty"`
+	Poster     bool                         `json:"poster,omitempty"`
+}
+
+type Record struct {
+	Seq         uint64                    `json:"seq"`
+	Job         job.Job                   `json:"job"`
+	Options     Options                   `json:"options"`
+	Status      string                    `json:"status"`
+	Stage       string                    `json:"stage"`
+	StageDetail string                    `json:"stageDetail,omitempty"`
+	Stages      []StageEvent              `json:"stages"`
+	Error       string                    `json:"error,omitempty"`
+	Result      *job.JobCompletionRequest `json:"result,omitempty"`
+	CreatedAt   time.Time                 `json:"createdAt"`
+	UpdatedAt   time.Time                 `json:"updatedAt"`
+	StartedAt   *time.Time                `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time                `json:"finishedAt,omitempty"`
+}
+
+func (r *Record) setStage(stage, detail string) {
+	now := time.Now()
+	r.Stage = stage
+	r.StageDetail = detail
+	r.Stages = append(r.Stages, StageEvent{
+		Stage:  stage,
+		Detail: detail,
+		At:     now,
+	})
+	r.UpdatedAt = now
+}
+
+// Queue is a durable FIFO of transcode jobs backed by a local bolt database,
+// so that accepted jobs survive restarts of the server.
+type Queue struct {
+	db       *bolt.DB
+	signal   chan struct{}
+	maxDepth int
+	// finished jobs are deleted once they are older than this, kept forever when 0
+	retention time.Duration
+	done      chan struct{}
+}
+
+func NewQueue(path string, maxDepth int, retention time.Duration) (*Queue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(createBuckets); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	q := &Queue{
+		db:        db,
+		signal:    make(chan struct{}, 1),
+		maxDepth:  maxDepth,
+		retention: retention,
+		done:      make(chan struct{}),
+	}
+
+	// jobs that were processing when the server went down are picked up again on boot
+	if err := q.requeueProcessing(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if retention > 0 {
+		if _, err := q.Prune(time.Now().Add(-retention)); err != nil {
+			db.Close()
+			return nil, err
+		}
+		go q.pruneLoop()
+	}
+
+	q.notify()
+
+	return q, nil
+}
+
+// createBuckets also builds the indexes of databases created before they existed
+func createBuckets(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucketIfNotExists(jobsBucket); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists(pendingBucket); err != nil {
+		return err
+	}
+	if tx.Bucket(seqBucket) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucket(seqBucket); err != nil {
+		return err
+	}
+
+	return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+		r := Record{}
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		return indexRecord(tx, &r)
+	})
+}
+
+func (q *Queue) Close() error {
+	close(q.done)
+	return q.db.Close()
+}
+
+func (q *Queue) pruneLoop() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+
+		pruned, err := q.Prune(time.Now().Add(-q.retention))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if pruned > 0 {
+			log.Printf("pruned %d finished jobs from the queue\n", pruned)
+		}
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func isFinished(status string) bool {
+	return status == job.StatusDone || status == job.StatusFailed || status == job.StatusCancelled
+}
+
+func getRecord(tx *bolt.Tx, jobId string) (*Record, error) {
+	data := tx.Bucket(jobsBucket).Get([]byte(jobId))
+	if data == nil {
+		return nil, ErrJobNotFound
+	}
+
+	r := Record{}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func putRecord(tx *bolt.Tx, r *Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(jobsBucket).Put([]byte(r.Job.Id), data); err != nil {
+		return err
+	}
+	return indexRecord(tx, r)
+}
+
+func indexRecord(tx *bolt.Tx, r *Record) error {
+	key := seqKey(r.Seq)
+	if err := tx.Bucket(seqBucket).Put(key, []byte(r.Job.Id)); err != nil {
+		return err
+	}
+
+	pending := tx.Bucket(pendingBucket)
+	if r.Status == job.StatusPending {
+		return pending.Put(key, []byte(r.Job.Id))
+	}
+	return pending.Delete(key)
+}
+
+func deleteRecord(tx *bolt.Tx, r *Record) error {
+	key := seqKey(r.Seq)
+	if err := tx.Bucket(seqBucket).Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(pendingBucket).Delete(key); err != nil {
+		return err
+	}
+	return tx.Bucket(jobsBucket).Delete([]byte(r.Job.Id))
+}
+
+func (q *Queue) requeueProcessing() error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		resumed := []Record{}
+		if err := tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			r := Record{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.Status == job.StatusProcessing {
+				resumed = append(resumed, r)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// records are written after the scan, bolt doesn't allow modifying a bucket while iterating it
+		for i := range resumed {
+			r := &resumed[i]
+			r.Status = job.StatusPending
+			r.StartedAt = nil
+			r.setStage(StageQueued, "resumed after restart")
+			if err := putRecord(tx, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func countPending(tx *bolt.Tx) int {
+	count := 0
+	c := tx.Bucket(pendingBucket).Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		count++
+	}
+	return count
+}
+
+// Depth returns the number of jobs waiting to be picked up by a worker
+func (q *Queue) Depth() (int, error) {
+	count := 0
+	err := q.db.View(func(tx *bolt.Tx) error {
+		count = countPending(tx)
+		return nil
+	})
+	return count, err
+}
+
+func (q *Queue) Enqueue(j job.Job, opts Options) (*Record, error) {
+	r := Record{
+		Job:       j,
+		Options:   opts,
+		Status:    job.StatusPending,
+		CreatedAt: time.Now(),
+	}
+	r.setStage(StageQueued, "")
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		existing, err := getRecord(tx, j.Id)
+		if err != nil && err != ErrJobNotFound {
+			return err
+		}
+		if existing != nil && (existing.Status == job.StatusPending || existing.Status == job.StatusProcessing) {
+			return ErrJobAlreadyQueued
+		}
+
+		if q.maxDepth > 0 && countPending(tx) >= q.maxDepth {
+			return ErrQueueFull
+		}
+
+		// a job that is enqueued again replaces its finished record at the back of the queue
+		if existing != nil {
+			if err := deleteRecord(tx, existing); err != nil {
+				return err
+			}
+		}
+
+		seq, err := tx.Bucket(jobsBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		r.Seq = seq
+
+		return putRecord(tx, &r)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	q.notify()
+
+	return &r, nil
+}
+
+// Next blocks until a pending job is available, marks it as processing and returns it
+func (q *Queue) Next(ctx context.Context) (*Record, error) {
+	for {
+		// a pool that is shutting down must not start another job
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		r, err := q.claimOldestPending()
+		if err != nil {
+			return nil, err
+		}
+
+		if r != nil {
+			// there may be more pending jobs behind this one
+			q.notify()
+			return r, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.signal:
+		}
+	}
+}
+
+func (q *Queue) claimOldestPending() (*Record, error) {
+	var claimed *Record
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		_, jobId := tx.Bucket(pendingBucket).Cursor().First()
+		if jobId == nil {
+			return nil
+		}
+
+		var err error
+		claimed, err = getRecord(tx, string(jobId))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		claimed.Status = job.StatusProcessing
+		claimed.StartedAt = &now
+		claimed.UpdatedAt = now
+
+		return putRecord(tx, claimed)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return claimed, nil
+}
+
+func (q *Queue) update(jobId string, fn func(r *Record)) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		r, err := getRecord(tx, jobId)
+		if err != nil {
+			return err
+		}
+		fn(r)
+		return putRecord(tx, r)
+	})
+}
+
+func (q *Queue) SetStage(jobId, stage, detail string) error {
+	return q.update(jobId, func(r *Record) {
+		r.setStage(stage, detail)
+	})
+}
+
+func (q *Queue) SetResult(jobId string, result *job.JobCompletionRequest) error {
+	return q.update(jobId, func(r *Record) {
+		r.Result = result
+		r.UpdatedAt = time.Now()
+	})
+}
+
+func (q *Queue) Complete(jobId string) error {
+	return q.update(jobId, func(r *Record) {
+		r.setStage(StageDone, "")
+		r.Status = job.StatusDone
+		r.FinishedAt = &r.UpdatedAt
+	})
+}
+
+func (q *Queue) Fail(jobId string, jobErr error) error {
+	return q.update(jobId, func(r *Record) {
+		r.setStage(StageFailed, "")
+		r.Status = job.StatusFailed
+		r.Error = jobErr.Error()
+		r.FinishedAt = &r.UpdatedAt
+	})
+}
+
+// Requeue puts a job that was interrupted back at its original position in the queue
+func (q *Queue) Requeue(jobId, reason string) error {
+	err := q.update(jobId, func(r *Record) {
+		r.setStage(StageQueued, reason)
+		r.Status = job.StatusPending
+		r.StartedAt = nil
+	})
+	if err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// CancelPending cancels a job that no worker has picked up yet
+func (q *Queue) CancelPending(jobId string) (*Record, error) {
+	var r *Record
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		r, err = getRecord(tx, jobId)
+		if err != nil {
+			return err
+		}
+		if r.Status != job.StatusPending {
+			return ErrJobNotPending
+		}
+		r.setStage(StageCancelled, "")
+		r.Status = job.StatusCancelled
+		r.FinishedAt = &r.UpdatedAt
+		return putRecord(tx, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// MarkCancelled records that a running job was stopped by a cancellation request
+func (q *Queue) MarkCancelled(jobId string) error {
+	return q.update(jobId, func(r *Record) {
+		r.setStage(StageCancelled, "")
+		r.Status = job.StatusCancelled
+		r.FinishedAt = &r.UpdatedAt
+	})
+}
+
+func (q *Queue) Get(jobId string) (*Record, error) {
+	var r *Record
+	err := q.db.View(func(tx *bolt.Tx) error {
+		var err error
+		r, err = getRecord(tx, jobId)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job %s: %w", jobId, err)
+	}
+	return r, nil
+}
+
+// List returns the most recently enqueued jobs first, optionally filtered by status
+func (q *Queue) List(status string, limit int) ([]Record, error) {
+	records := []Record{}
+
+	index := seqBucket
+	if status == job.StatusPending {
+		index = pendingBucket
+	}
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(index).Cursor()
+		for _, jobId := c.Last(); jobId != nil; _, jobId = c.Prev() {
+			if limit > 0 && len(records) >= limit {
+				return nil
+			}
+			r, err := getRecord(tx, string(jobId))
+			if err != nil {
+				return err
+			}
+			if status == "" || r.Status == status {
+				records = append(records, *r)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// Prune deletes the jobs that finished before the given time and returns how many were deleted
+func (q *Queue) Prune(before time.Time) (int, error) {
+	pruned := 0
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		expired := []*Record{}
+		if err := tx.Bucket(seqBucket).ForEach(func(k, jobId []byte) error {
+			r, err := getRecord(tx, string(jobId))
+			if err != nil {
+				return err
+			}
+			if isFinished(r.Status) && r.FinishedAt != nil && r.FinishedAt.Before(before) {
+				expired = append(expired, r)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, r := range expired {
+			if err := deleteRecord(tx, r); err != nil {
+				return err
+			}
+		}
+		pruned = len(expired)
+		return nil
+	})
+
+	return pruned, err
+}
@@ -0,0 +1,315 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/job"
+)
+
+func newTestQueue(t *testing.T, path string, maxDepth int) *Queue {
+	t.Helper()
+	q, err := NewQueue(path, maxDepth, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func enqueue(t *testing.T, q *Queue, jobIds ...string) {
+	t.Helper()
+	for _, jobId := range jobIds {
+		if _, err := q.Enqueue(job.Job{Id: jobId}, Options{}); err != nil {
+			t.Fatalf("enqueue %s: %s", jobId, err)
+		}
+	}
+}
+
+func claim(t *testing.T, q *Queue) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r, err := q.Next(ctx)
+	if err != nil {
+		t.Fatalf("next: %s", err)
+	}
+	if r.Status != job.StatusProcessing {
+		t.Fatalf("claimed job %s is %s, want %s", r.Job.Id, r.Status, job.StatusProcessing)
+	}
+	return r.Job.Id
+}
+
+func TestQueueClaimOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, q *Queue)
+		want  []string
+	}{
+		{
+			name: "claims in enqueue order",
+			setup: func(t *testing.T, q *Queue) {
+				enqueue(t, q, "a", "b", "c")
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "requeued job keeps its position",
+			setup: func(t *testing.T, q *Queue) {
+				enqueue(t, q, "a", "b", "c")
+				claim(t, q)
+				if err := q.Requeue("a", "interrupted"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "finished job enqueued again goes to the back",
+			setup: func(t *testing.T, q *Queue) {
+				enqueue(t, q, "a", "b")
+				claim(t, q)
+				if err := q.Fail("a", errors.New("failed")); err != nil {
+					t.Fatal(err)
+				}
+				enqueue(t, q, "a")
+			},
+			want: []string{"b", "a"},
+		},
+		{
+			name: "cancelled pending job is skipped",
+			setup: func(t *testing.T, q *Queue) {
+				enqueue(t, q, "a", "b", "c")
+				if _, err := q.CancelPending("b"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"a", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t, filepath.Join(t.TempDir(), "jobs.db"), 10)
+			defer q.Close()
+			tt.setup(t, q)
+
+			for _, want := range tt.want {
+				if got := claim(t, q); got != want {
+					t.Fatalf("claimed %s, want %s", got, want)
+				}
+			}
+
+			depth, err := q.Depth()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if depth != 0 {
+				t.Fatalf("depth is %d after claiming every job, want 0", depth)
+			}
+		})
+	}
+}
+
+func TestQueueRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	q := newTestQueue(t, path, 10)
+	enqueue(t, q, "a", "b", "c")
+	claim(t, q)
+	claim(t, q)
+	if err := q.Complete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = newTestQueue(t, path, 10)
+	defer q.Close()
+
+	r, err := q.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != job.StatusPending || r.StageDetail != "resumed after restart" {
+		t.Fatalf("job interrupted by the restart is %s (%s), want it pending again", r.Status, r.StageDetail)
+	}
+
+	for _, want := range []string{"b", "c"} {
+		if got := claim(t, q); got != want {
+			t.Fatalf("claimed %s, want %s", got, want)
+		}
+	}
+
+	r, err = q.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != job.StatusDone {
+		t.Fatalf("finished job is %s after the restart, want %s", r.Status, job.StatusDone)
+	}
+}
+
+func TestQueueEnqueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxDepth int
+		setup    func(t *testing.T, q *Queue)
+		jobId    string
+		wantErr  error
+	}{
+		{
+			name:     "pending job",
+			maxDepth: 10,
+			setup: func(t *testing.T, q *Queue) {
+				enqueue(t, q, "a")
+			},
+			jobId:   "a",
+			wantErr: ErrJobAlreadyQueued,
+		},
+		{
+			name:     "processing job",
+			maxDepth: 10,
+			setup: func(t *testing.T, q *Queue) {
+				enqueue(t, q, "a")
+				claim(t, q)
+			},
+			jobId:   "a",
+			wantErr: ErrJobAlreadyQueued,
+		},
+		{
+			name:     "full queue",
+			maxDepth: 2,
+			setup: func(t *testing.T, q *Queue) {
+				enqueue(t, q, "a", "b")
+			},
+			jobId:   "c",
+			wantErr: ErrQueueFull,
+		},
+		{
+			name:     "processing jobs do not count towards the depth",
+			maxDepth: 2,
+			setup: func(t *testing.T, q *Queue) {
+				enqueue(t, q, "a", "b")
+				claim(t, q)
+			},
+			jobId: "c",
+		},
+		{
+			name:     "cancelled job",
+			maxDepth: 10,
+			setup: func(t *testing.T, q *Queue) {
+				enqueue(t, q, "a")
+				if _, err := q.CancelPending("a"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			jobId: "a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t, filepath.Join(t.TempDir(), "jobs.db"), tt.maxDepth)
+			defer q.Close()
+			tt.setup(t, q)
+
+			_, err := q.Enqueue(job.Job{Id: tt.jobId}, Options{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueueNextCancelled(t *testing.T) {
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "jobs.db"), 10)
+	defer q.Close()
+	enqueue(t, q, "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.Next(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+
+	r, err := q.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != job.StatusPending {
+		t.Fatalf("job is %s after a cancelled claim, want %s", r.Status, job.StatusPending)
+	}
+}
+
+func TestQueueList(t *testing.T) {
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "jobs.db"), 10)
+	defer q.Close()
+	enqueue(t, q, "a", "b", "c", "d")
+	claim(t, q)
+
+	tests := []struct {
+		status string
+		limit  int
+		want   []string
+	}{
+		{status: "", limit: 0, want: []string{"d", "c", "b", "a"}},
+		{status: "", limit: 2, want: []string{"d", "c"}},
+		{status: job.StatusPending, limit: 0, want: []string{"d", "c", "b"}},
+		{status: job.StatusProcessing, limit: 0, want: []string{"a"}},
+		{status: job.StatusDone, limit: 0, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		records, err := q.List(tt.status, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, r := range records {
+			got = append(got, r.Job.Id)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("List(%q, %d) = %v, want %v", tt.status, tt.limit, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("List(%q, %d) = %v, want %v", tt.status, tt.limit, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestQueuePrune(t *testing.T) {
+	q := newTestQueue(t, filepath.Join(t.TempDir(), "jobs.db"), 10)
+	defer q.Close()
+	enqueue(t, q, "a", "b", "c", "d")
+	claim(t, q)
+	claim(t, q)
+	if err := q.Complete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.CancelPending("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := q.Prune(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Fatalf("pruned %d jobs, want 2", pruned)
+	}
+
+	for jobId, want := range map[string]error{"a": ErrJobNotFound, "b": nil, "c": ErrJobNotFound, "d": nil} {
+		if _, err := q.Get(jobId); !errors.Is(err, want) {
+			t.Fatalf("got error %v for job %s, want %v", err, jobId, want)
+		}
+	}
+
+	if got := claim(t, q); got != "d" {
+		t.Fatalf("claimed %s, want d", got)
+	}
+}
@@ -0,0 +1,209 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/zihaolam/golang-media-upload-server/internal"
+)
+
+// steps are also listed in the validation of RETRY_STEP_MAX_ATTEMPTS in internal/env.go
+const StepDownload = "download"
+const StepProbe = "probe"
+const StepTranscode = "transcode"
+const StepTranscribe = "transcribe"
+const StepTranslate = "translate"
+const StepUpload = "upload"
+const StepCompletionWebhook = "completion_webhook"
+
+// exit code reported for a process killed with SIGKILL when it runs behind a shell or container runtime
+const exitCodeKilled = 137
+
+type Policy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Error is returned by Do once a step has given up, carrying how many attempts were made
+type Error struct {
+	Step     string
+	Attempts int
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s failed after %d attempt(s): %s", e.Step, e.Attempts, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fatalError) Unwrap() error {
+	return e.err
+}
+
+// Fatal marks an error as not worth retrying
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fatalError{err: err}
+}
+
+// IsRetryable reports whether err looks transient, e.g. throttling, 5xx responses, network failures
+// or a crashed ffmpeg process. Errors that are not recognised are treated as fatal.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var fatal *fatalError
+	if errors.As(err, &fatal) {
+		return false
+	}
+
+	// a nested step such as the upload at the end of a transcode has already used up its own attempts,
+	// retrying the outer step would redo all of its work for the same failure
+	var exhausted *Error
+	if errors.As(err, &exhausted) {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var retryable interface{ Retryable() bool }
+	if errors.As(err, &retryable) {
+		return retryable.Retryable()
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return isRetryableStatus(apiErr.HTTPStatusCode)
+	}
+
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return isRetryableStatus(requestErr.HTTPStatusCode)
+	}
+
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		return isRetryableStatus(requestFailure.StatusCode()) || request.IsErrorThrottle(requestFailure)
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return request.IsErrorRetryable(awsErr) || request.IsErrorThrottle(awsErr)
+	}
+
+	// ffmpeg failures are deterministic for invalid options or encoder errors, only a process killed
+	// by the system, such as by the oom killer, is worth running again
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		return (ok && status.Signaled()) || exitErr.ExitCode() == exitCodeKilled
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// PolicyFor returns the configured policy of a step, where RETRY_STEP_MAX_ATTEMPTS
+// can override the default number of attempts per step, e.g. "transcode=1,transcribe=5"
+func PolicyFor(step string) Policy {
+	maxAttempts := internal.Env.RetryMaxAttempts
+	if stepMaxAttempts, ok := internal.Env.RetryStepMaxAttempts[step]; ok {
+		maxAttempts = stepMaxAttempts
+	}
+
+	return Policy{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: time.Duration(internal.Env.RetryInitialBackoff) * time.Millisecond,
+		MaxBackoff:     time.Duration(internal.Env.RetryMaxBackoff) * time.Millisecond,
+	}
+}
+
+func (p Policy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff << (attempt - 1)
+	// the shift overflows for large attempt counts
+	if p.MaxBackoff > 0 && (backoff > p.MaxBackoff || backoff < p.InitialBackoff) {
+		backoff = p.MaxBackoff
+	}
+	// up to 20% jitter so that retries of parallel steps do not line up
+	if backoff > 0 {
+		backoff += time.Duration(rand.Int63n(int64(backoff)/5 + 1))
+	}
+	return backoff
+}
+
+// Do runs fn until it succeeds, returns a fatal error or the policy runs out of attempts
+func Do(ctx context.Context, step string, policy Policy, fn func(ctx context.Context) error) error {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+
+		if attempt >= maxAttempts || !IsRetryable(err) {
+			return &Error{
+				Step:     step,
+				Attempts: attempt,
+				Err:      err,
+			}
+		}
+
+		backoff := policy.backoff(attempt)
+		log.Printf("%s attempt %d/%d failed, retrying in %s: %s\n", step, attempt, maxAttempts, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return &Error{
+				Step:     step,
+				Attempts: attempt,
+				Err:      ctx.Err(),
+			}
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Attempts returns how many attempts were made before err was returned by Do
+func Attempts(err error) int {
+	var retryErr *Error
+	if errors.As(err, &retryErr) {
+		return retryErr.Attempts
+	}
+	return 1
+}
@@ -0,0 +1,145 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+type statusError struct {
+	statusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d", e.statusCode)
+}
+
+func (e *statusError) Retryable() bool {
+	return isRetryableStatus(e.statusCode)
+}
+
+func exitError(t *testing.T, script string) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", script).Run()
+	if err == nil {
+		t.Fatal("expected the command to fail")
+	}
+	return err
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "unknown error", err: errors.New("invalid input"), want: false},
+		{name: "fatal", err: Fatal(&statusError{statusCode: http.StatusServiceUnavailable}), want: false},
+		{name: "cancelled", err: context.Canceled, want: false},
+		{name: "deadline exceeded", err: fmt.Errorf("transcode: %w", context.DeadlineExceeded), want: false},
+		{name: "too many requests", err: &statusError{statusCode: http.StatusTooManyRequests}, want: true},
+		{name: "server error", err: fmt.Errorf("webhook: %w", &statusError{statusCode: http.StatusBadGateway}), want: true},
+		{name: "client error", err: &statusError{statusCode: http.StatusBadRequest}, want: false},
+		{name: "openai rate limit", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "openai bad request", err: &openai.APIError{HTTPStatusCode: http.StatusBadRequest}, want: false},
+		{name: "s3 server error", err: awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), http.StatusInternalServerError, ""), want: true},
+		{name: "s3 throttled", err: awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), http.StatusServiceUnavailable, ""), want: true},
+		{name: "s3 access denied", err: awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), http.StatusForbidden, ""), want: false},
+		{name: "ffmpeg failure", err: exitError(t, "exit 1"), want: false},
+		{name: "ffmpeg killed", err: exitError(t, "kill -9 $$"), want: true},
+		{name: "ffmpeg killed behind a shell", err: exitError(t, "exit 137"), want: true},
+		{
+			name: "exhausted nested step",
+			err:  &Error{Step: StepUpload, Attempts: 3, Err: &statusError{statusCode: http.StatusServiceUnavailable}},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Fatalf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	transient := &statusError{statusCode: http.StatusServiceUnavailable}
+	errUnknown := errors.New("invalid input")
+
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		errs         []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{name: "succeeds first time", maxAttempts: 3, errs: []error{nil}, wantAttempts: 1},
+		{name: "succeeds after transient failures", maxAttempts: 3, errs: []error{transient, transient, nil}, wantAttempts: 3},
+		{name: "runs out of attempts", maxAttempts: 3, errs: []error{transient, transient, transient}, wantErr: transient, wantAttempts: 3},
+		{name: "stops at a fatal error", maxAttempts: 3, errs: []error{transient, Fatal(transient)}, wantErr: transient, wantAttempts: 2},
+		{name: "stops at an unknown error", maxAttempts: 3, errs: []error{errUnknown}, wantErr: errUnknown, wantAttempts: 1},
+		{name: "runs at least once", maxAttempts: 0, errs: []error{transient}, wantErr: transient, wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := Do(context.Background(), StepTranscode, Policy{MaxAttempts: tt.maxAttempts}, func(ctx context.Context) error {
+				err := tt.errs[attempts]
+				attempts++
+				return err
+			})
+
+			if attempts != tt.wantAttempts {
+				t.Fatalf("made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("got error %v, want nil", err)
+				}
+				return
+			}
+
+			var retryErr *Error
+			if !errors.As(err, &retryErr) {
+				t.Fatalf("got error %v, want a *Error", err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if retryErr.Step != StepTranscode || retryErr.Attempts != tt.wantAttempts {
+				t.Fatalf("got %s after %d attempts, want %s after %d", retryErr.Step, retryErr.Attempts, StepTranscode, tt.wantAttempts)
+			}
+			if Attempts(err) != tt.wantAttempts {
+				t.Fatalf("Attempts() = %d, want %d", Attempts(err), tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestDoCancelledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := Do(ctx, StepUpload, Policy{MaxAttempts: 5, InitialBackoff: time.Hour}, func(ctx context.Context) error {
+		attempts++
+		cancel()
+		return &statusError{statusCode: http.StatusServiceUnavailable}
+	})
+
+	if attempts != 1 {
+		t.Fatalf("made %d attempts, want 1", attempts)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+}
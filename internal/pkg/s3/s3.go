@@ -94,6 +94,30 @@ func getFileType(path string) string {
 	if filepath.Ext(path) == ".ts" {
 		return "video/mp2t"
 	}
+	if filepath.Ext(path) == ".mp4" {
+		return "video/mp4"
+	}
+	if filepath.Ext(path) == ".m4s" {
+		return "video/iso.segment"
+	}
+	if filepath.Ext(path) == ".mpd" {
+		return "application/dash+xml"
+	}
+	if filepath.Ext(path) == ".json" {
+		return "application/json"
+	}
+	if filepath.Ext(path) == ".vtt" {
+		return "text/vtt"
+	}
+	if filepath.Ext(path) == ".jpeg" {
+		return "image/jpeg"
+	}
+	if filepath.Ext(path) == ".png" {
+		return "image/png"
+	}
+	if filepath.Ext(path) == ".webp" {
+		return "image/webp"
+	}
 
 	return ""
 }
@@ -142,6 +166,11 @@ func GetAbsolutePath(path string) string {
 	return fmt.Sprintf("%s/%s", internal.Env.PublicAssetEndpoint, path)
 }
 
+// Strips the public asset endpoint from a url, returning the object key
+func GetRelativePath(url string) string {
+	return strings.TrimPrefix(strings.Replace(url, internal.Env.PublicAssetEndpoint, "", 1), "/")
+}
+
 // Download object to specific file and return the file, remember to cleanup file after use
 func (sc *S3Client) GetObject(ctx context.Context, key string) (*os.File, error) {
 	strippedKey := strings.Replace(key, internal.Env.PublicAssetEndpoint, "", 1)
@@ -151,16 +180,18 @@ func (sc *S3Client) GetObject(ctx context.Context, key string) (*os.File, error)
 	}
 
 	file, err := os.CreateTemp("", fmt.Sprintf("*_%s", filepath.Base(key)))
-	log.Println(file.Name())
 	if err != nil {
 		return nil, err
 	}
+	log.Println(file.Name())
 
 	downloader := s3manager.NewDownloader(sess)
 	if _, err = downloader.DownloadWithContext(ctx, file, &s3.GetObjectInput{
 		Bucket: aws.String(sc.bucket),
 		Key:    aws.String(strippedKey),
 	}); err != nil {
+		file.Close()
+		os.Remove(file.Name())
 		return nil, err
 	}
 
@@ -175,34 +206,38 @@ func (sc *S3Client) DeleteObject(ctx context.Context, key string) error {
 	return err
 }
 
+// DeleteDirectory deletes every object under the prefix dir, a page of at most 1000 keys at a time
 func (sc *S3Client) DeleteDirectory(ctx context.Context, dir string) error {
-	objects, err := sc.s3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+	var deleteErr error
+	err := sc.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
 		Prefix: aws.String(dir),
 		Bucket: aws.String(sc.bucket),
-	})
-
-	if err != nil {
-		return err
-	}
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
 
-	if len(objects.Contents) == 0 {
-		return nil
-	}
+		objectsToDelete := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
 
-	objectsToDelete := make([]*s3.ObjectIdentifier, 0, len(objects.Contents))
+		for _, object := range page.Contents {
+			objectsToDelete = append(objectsToDelete, &s3.ObjectIdentifier{
+				Key: object.Key,
+			})
+		}
 
-	for _, object := range objects.Contents {
-		objectsToDelete = append(objectsToDelete, &s3.ObjectIdentifier{
-			Key: object.Key,
+		_, deleteErr = sc.s3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(sc.bucket),
+			Delete: &s3.Delete{
+				Objects: objectsToDelete,
+			},
 		})
-	}
 
-	_, err = sc.s3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
-		Bucket: aws.String(sc.bucket),
-		Delete: &s3.Delete{
-			Objects: objectsToDelete,
-		},
+		return deleteErr == nil
 	})
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	return deleteErr
 }
@@ -0,0 +1,202 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/queue"
+)
+
+const StateIdle = "idle"
+const StateBusy = "busy"
+
+// how long interrupted jobs get to stop and report their outcome once the shutdown deadline has passed,
+// jobs that still have not returned are picked up again by the queue on the next boot
+const interruptGracePeriod = 30 * time.Second
+
+// ErrJobCancelled is the cancellation cause of a job context stopped through Pool.Cancel
+var ErrJobCancelled = errors.New("job was cancelled")
+
+// ErrShuttingDown is the cancellation cause of jobs still running when Pool.Shutdown times out
+var ErrShuttingDown = errors.New("worker pool is shutting down")
+
+type Handler = func(ctx context.Context, r *queue.Record) error
+
+type Status struct {
+	Id        int        `json:"id"`
+	State     string     `json:"state"`
+	JobId     string     `json:"jobId,omitempty"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	Processed int        `json:"processed"`
+	Failed    int        `json:"failed"`
+}
+
+// Pool runs a fixed number of workers that consume jobs from the queue
+type Pool struct {
+	queue   *queue.Queue
+	handler Handler
+	mu      sync.RWMutex
+	workers []Status
+	cancels map[string]context.CancelCauseFunc
+	wg      sync.WaitGroup
+	// stops workers from claiming new jobs
+	stop context.CancelFunc
+	// interrupts running jobs
+	cancelJobs context.CancelCauseFunc
+	requeue    bool
+}
+
+func NewPool(q *queue.Queue, size int, handler Handler) *Pool {
+	workers := make([]Status, size)
+	for i := range workers {
+		workers[i] = Status{
+			Id:    i,
+			State: StateIdle,
+		}
+	}
+
+	return &Pool{
+		queue:   q,
+		handler: handler,
+		workers: workers,
+		cancels: map[string]context.CancelCauseFunc{},
+	}
+}
+
+func (p *Pool) Start(ctx context.Context) {
+	claimCtx, stop := context.WithCancel(ctx)
+	jobsCtx, cancelJobs := context.WithCancelCause(ctx)
+	p.stop = stop
+	p.cancelJobs = cancelJobs
+
+	for i := range p.workers {
+		p.wg.Add(1)
+		go p.work(claimCtx, jobsCtx, i)
+	}
+}
+
+// Wait blocks until every worker has exited
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
+
+// Shutdown stops workers from picking up new jobs and waits for the running ones to finish.
+// Jobs still running once ctx is done are cancelled with ErrShuttingDown and then either
+// put back in the queue to be resumed on the next boot, or failed. Jobs that ignore the
+// cancellation are given up on after interruptGracePeriod.
+func (p *Pool) Shutdown(ctx context.Context, requeue bool) {
+	p.mu.Lock()
+	p.requeue = requeue
+	p.mu.Unlock()
+
+	p.stop()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	log.Println("shutdown deadline exceeded, interrupting running jobs")
+	p.cancelJobs(ErrShuttingDown)
+
+	select {
+	case <-done:
+	case <-time.After(interruptGracePeriod):
+		log.Println("interrupted jobs did not stop in time, leaving them to be resumed on the next boot")
+	}
+}
+
+func (p *Pool) setStatus(id int, fn func(s *Status)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(&p.workers[id])
+}
+
+func (p *Pool) Statuses() []Status {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	statuses := make([]Status, len(p.workers))
+	copy(statuses, p.workers)
+	return statuses
+}
+
+// Cancel stops a running job, returning false if no worker is processing it
+func (p *Pool) Cancel(jobId string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cancel, ok := p.cancels[jobId]
+	if ok {
+		cancel(ErrJobCancelled)
+	}
+	return ok
+}
+
+func (p *Pool) work(claimCtx, jobsCtx context.Context, id int) {
+	defer p.wg.Done()
+
+	for {
+		r, err := p.queue.Next(claimCtx)
+		if err != nil {
+			if claimCtx.Err() == nil {
+				log.Println(err)
+			}
+			return
+		}
+
+		jobCtx, cancel := context.WithCancelCause(jobsCtx)
+
+		p.setStatus(id, func(s *Status) {
+			now := time.Now()
+			s.State = StateBusy
+			s.JobId = r.Job.Id
+			s.StartedAt = &now
+			p.cancels[r.Job.Id] = cancel
+		})
+
+		jobErr := p.handler(jobCtx, r)
+		cancelled := errors.Is(context.Cause(jobCtx), ErrJobCancelled)
+		interrupted := errors.Is(context.Cause(jobCtx), ErrShuttingDown)
+
+		p.mu.RLock()
+		requeue := p.requeue
+		p.mu.RUnlock()
+
+		if jobErr != nil && interrupted && requeue {
+			if err := p.queue.Requeue(r.Job.Id, "interrupted by shutdown"); err != nil {
+				log.Println(err)
+			}
+		} else if jobErr != nil && cancelled {
+			if err := p.queue.MarkCancelled(r.Job.Id); err != nil {
+				log.Println(err)
+			}
+		} else if jobErr != nil {
+			if err := p.queue.Fail(r.Job.Id, jobErr); err != nil {
+				log.Println(err)
+			}
+		} else if err := p.queue.Complete(r.Job.Id); err != nil {
+			log.Println(err)
+		}
+
+		p.setStatus(id, func(s *Status) {
+			delete(p.cancels, r.Job.Id)
+			cancel(nil)
+			s.State = StateIdle
+			s.JobId = ""
+			s.StartedAt = nil
+			s.Processed++
+			if jobErr != nil {
+				s.Failed++
+			}
+		})
+	}
+}
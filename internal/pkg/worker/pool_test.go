@@ -0,0 +1,197 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/job"
+	"github.com/zihaolam/golang-media-upload-server/internal/pkg/queue"
+)
+
+func newTestQueue(t *testing.T, jobIds ...string) *queue.Queue {
+	t.Helper()
+	q, err := queue.NewQueue(filepath.Join(t.TempDir(), "jobs.db"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+
+	for _, jobId := range jobIds {
+		if _, err := q.Enqueue(job.Job{Id: jobId}, queue.Options{}); err != nil {
+			t.Fatalf("enqueue %s: %s", jobId, err)
+		}
+	}
+	return q
+}
+
+func wantStatus(t *testing.T, q *queue.Queue, jobId, want string) {
+	t.Helper()
+	r, err := q.Get(jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != want {
+		t.Fatalf("job %s is %s, want %s", jobId, r.Status, want)
+	}
+}
+
+// blockingHandler holds every job until its context is done, signalling started once it is running
+func blockingHandler(started chan<- string) Handler {
+	return func(ctx context.Context, r *queue.Record) error {
+		started <- r.Job.Id
+		<-ctx.Done()
+		return context.Cause(ctx)
+	}
+}
+
+func waitStarted(t *testing.T, started <-chan string) string {
+	t.Helper()
+	select {
+	case jobId := <-started:
+		return jobId
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a job to start")
+		return ""
+	}
+}
+
+func TestPoolRecordsOutcomes(t *testing.T) {
+	q := newTestQueue(t, "a", "b", "c", "d")
+
+	var mu sync.Mutex
+	handled := map[string]bool{}
+	var wg sync.WaitGroup
+	wg.Add(4)
+	pool := NewPool(q, 2, func(ctx context.Context, r *queue.Record) error {
+		defer wg.Done()
+		mu.Lock()
+		handled[r.Job.Id] = true
+		mu.Unlock()
+		if r.Job.Id == "b" {
+			return errors.New("encoder failed")
+		}
+		return nil
+	})
+	pool.Start(context.Background())
+	wg.Wait()
+	pool.Shutdown(context.Background(), false)
+
+	if len(handled) != 4 {
+		t.Fatalf("handled %v, want every job", handled)
+	}
+	for _, jobId := range []string{"a", "c", "d"} {
+		wantStatus(t, q, jobId, job.StatusDone)
+	}
+	wantStatus(t, q, "b", job.StatusFailed)
+
+	processed, failed := 0, 0
+	for _, status := range pool.Statuses() {
+		if status.State != StateIdle || status.JobId != "" {
+			t.Fatalf("worker %d is %s with job %q after shutdown", status.Id, status.State, status.JobId)
+		}
+		processed += status.Processed
+		failed += status.Failed
+	}
+	if processed != 4 || failed != 1 {
+		t.Fatalf("workers processed %d jobs and failed %d, want 4 and 1", processed, failed)
+	}
+}
+
+func TestPoolRunsJobsConcurrently(t *testing.T) {
+	q := newTestQueue(t, "a", "b", "c")
+	started := make(chan string, 3)
+	pool := NewPool(q, 2, blockingHandler(started))
+	pool.Start(context.Background())
+
+	running := map[string]bool{waitStarted(t, started): true, waitStarted(t, started): true}
+	if !running["a"] || !running["b"] {
+		t.Fatalf("running %v, want a and b", running)
+	}
+	select {
+	case jobId := <-started:
+		t.Fatalf("job %s started with every worker busy", jobId)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pool.Cancel("a")
+	if jobId := waitStarted(t, started); jobId != "c" {
+		t.Fatalf("started %s once a worker was free, want c", jobId)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool.Shutdown(ctx, false)
+}
+
+func TestPoolCancel(t *testing.T) {
+	q := newTestQueue(t, "a")
+	started := make(chan string, 1)
+	pool := NewPool(q, 1, blockingHandler(started))
+	pool.Start(context.Background())
+	waitStarted(t, started)
+
+	if pool.Cancel("unknown") {
+		t.Fatal("cancelled a job that is not running")
+	}
+	if !pool.Cancel("a") {
+		t.Fatal("could not cancel the running job")
+	}
+
+	pool.Shutdown(context.Background(), false)
+	wantStatus(t, q, "a", job.StatusCancelled)
+}
+
+func TestPoolShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		requeue bool
+		want    string
+	}{
+		{name: "requeues interrupted jobs", requeue: true, want: job.StatusPending},
+		{name: "fails interrupted jobs", requeue: false, want: job.StatusFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t, "a", "b")
+			started := make(chan string, 2)
+			pool := NewPool(q, 1, blockingHandler(started))
+			pool.Start(context.Background())
+			waitStarted(t, started)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			pool.Shutdown(ctx, tt.requeue)
+
+			wantStatus(t, q, "a", tt.want)
+			// no new job is claimed once shutdown has begun
+			wantStatus(t, q, "b", job.StatusPending)
+		})
+	}
+}
+
+func TestPoolShutdownWaitsForRunningJobs(t *testing.T) {
+	q := newTestQueue(t, "a")
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	pool := NewPool(q, 1, func(ctx context.Context, r *queue.Record) error {
+		started <- r.Job.Id
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	})
+	pool.Start(context.Background())
+	waitStarted(t, started)
+
+	time.AfterFunc(20*time.Millisecond, func() { close(release) })
+	pool.Shutdown(context.Background(), false)
+
+	wantStatus(t, q, "a", job.StatusDone)
+}